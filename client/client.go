@@ -7,21 +7,45 @@ import (
 	"github.com/trueos/sysup/defines"
 	"log"
 	"os"
+	"time"
 )
 
 // Show us our list of trains
-func printtrains(trains []defines.TrainDef, deftrain string) {
+func printtrains(
+	trains []defines.TrainDef, deftrain string, stale bool, fetched string,
+) {
+	if stale {
+		fmt.Println(
+			"WARNING: Unable to reach the trains server, showing the " +
+				"cached list from " + fetched,
+		)
+		fmt.Println("")
+	}
 	fmt.Println("Current Train: " + deftrain)
 	fmt.Println("")
 	fmt.Println("The following trains are available:")
 	fmt.Println(
 		"------------------------------------------------------------------",
 	)
+	// Only bother showing sources if we have more than one
+	var multisrc bool
+	for i := range trains {
+		if trains[i].Source != trains[0].Source {
+			multisrc = true
+			break
+		}
+	}
 	for i := range trains {
 		fmt.Printf("%s\t\t\t%s", trains[i].Name, trains[i].Description)
+		if multisrc {
+			fmt.Printf(" (%s)", trains[i].Source)
+		}
 		if trains[i].Deprecated {
 			fmt.Printf(" [Deprecated]")
 		}
+		if trains[i].Incompatible != "" {
+			fmt.Printf(" [Incompatible: %s]", trains[i].Incompatible)
+		}
 		for j := range trains[i].Tags {
 			fmt.Printf(" [%s]", trains[i].Tags[j])
 		}
@@ -48,6 +72,7 @@ func parsejsonmsg(message []byte) int {
 		if err := json.Unmarshal(message, &s); err != nil {
 			log.Fatal(err)
 		}
+		printpending(s.Pending)
 		var haveupdates bool = s.Updates
 		if haveupdates {
 			fmt.Println("The following updates are available")
@@ -67,27 +92,75 @@ func parsejsonmsg(message []byte) int {
 		}
 		var infomsg string = s.Info
 		fmt.Println(infomsg)
+	case "traindeprecated":
+		var s struct {
+			defines.Envelope
+			defines.TrainDeprecated
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("WARNING: The current train " + s.Train +
+			" is deprecated")
+		if s.NewTrain != "" {
+			fmt.Println("The replacement train is: " + s.NewTrain)
+			if !s.Follow {
+				fmt.Println(
+					"Use \"sysup -change-train " + s.NewTrain +
+						"\" to switch",
+				)
+			}
+		}
+	case "scheduler":
+		var s struct {
+			defines.Envelope
+			Event   string `json:"event"`
+			Updates bool   `json:"updates"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Scheduled %s finished (updates: %t)\n", s.Event, s.Updates)
 	case "updatebootloader":
 		var s struct {
 			defines.Envelope
 			defines.InfoMsg
+			Report *defines.LoaderReport `json:"report"`
 		}
 		if err := json.Unmarshal(message, &s); err != nil {
 			log.Fatal(err)
 		}
 		var infomsg string = s.Info
 		fmt.Println(infomsg)
+		if s.Report != nil {
+			printloader(*s.Report)
+			if s.Report.Status != "ok" {
+				os.Exit(1)
+			}
+		}
+		os.Exit(0)
+	case "bootloaderinfo":
+		var s struct {
+			defines.Envelope
+			Report defines.LoaderReport `json:"report"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		printloader(s.Report)
 		os.Exit(0)
 	case "listtrains":
 		var s struct {
 			defines.Envelope
 			Trains  []defines.TrainDef `json:"trains"`
 			Default string             `json:"default"`
+			Stale   bool               `json:"stale"`
+			Fetched string             `json:"fetched"`
 		}
 		if err := json.Unmarshal(message, &s); err != nil {
 			log.Fatal(err)
 		}
-		printtrains(s.Trains, s.Default)
+		printtrains(s.Trains, s.Default, s.Stale, s.Fetched)
 		os.Exit(0)
 	case "settrain":
 		var s struct {
@@ -99,6 +172,157 @@ func parsejsonmsg(message []byte) int {
 		}
 		fmt.Println("Train set to: " + s.Train)
 		os.Exit(0)
+	case "trainpreview":
+		var s struct {
+			defines.Envelope
+			Train   string              `json:"train"`
+			Updates bool                `json:"updates"`
+			Details *defines.UpdateInfo `json:"details"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		if s.Updates && s.Details != nil {
+			fmt.Println("Changing to train " + s.Train +
+				" will make the following changes")
+			printupdatedetails(*s.Details)
+		} else {
+			fmt.Println("Changing to train " + s.Train +
+				" will not change any packages")
+		}
+		fmt.Println()
+		fmt.Println("Train not changed, run without -preview to apply")
+		os.Exit(0)
+	case "status":
+		var s struct {
+			defines.Envelope
+			Pending *defines.PendingReboot `json:"pending"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		if s.Pending == nil {
+			fmt.Println("No update is waiting on a reboot")
+			os.Exit(0)
+		}
+		printpending(s.Pending)
+		os.Exit(10)
+	case "reboot":
+		var s struct {
+			defines.Envelope
+			At        time.Time `json:"at"`
+			Remaining int       `json:"remaining"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf(
+			"Rebooting in %s (at %s)\n",
+			time.Duration(s.Remaining)*time.Second, s.At.Format(time.RFC1123),
+		)
+	case "rebootcancelled":
+		fmt.Println("Scheduled reboot cancelled")
+		os.Exit(0)
+	case "prunebes":
+		var s struct {
+			defines.Envelope
+			DryRun    bool     `json:"dryrun"`
+			Destroyed []string `json:"destroyed"`
+			Kept      []string `json:"kept"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		if s.DryRun {
+			fmt.Println("The following boot-environments would be destroyed:")
+		} else {
+			fmt.Println("The following boot-environments were destroyed:")
+		}
+		fmt.Println("----------------------------------------------------")
+		for i := range s.Destroyed {
+			fmt.Println("   " + s.Destroyed[i])
+		}
+		fmt.Println()
+		fmt.Println("The following boot-environments are kept:")
+		fmt.Println("----------------------------------------------------")
+		for i := range s.Kept {
+			fmt.Println("   " + s.Kept[i])
+		}
+		os.Exit(0)
+	case "listbes":
+		var s struct {
+			defines.Envelope
+			BEs []defines.BEInfo `json:"bes"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		printbes(s.BEs)
+		os.Exit(0)
+	case "activatebe", "renamebe", "pinbe", "destroybe":
+		var s struct {
+			defines.Envelope
+			BEName string `json:"bename"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		switch env.Method {
+		case "activatebe":
+			fmt.Println("Activated boot-environment: " + s.BEName)
+		case "renamebe":
+			fmt.Println("Renamed boot-environment to: " + s.BEName)
+		case "pinbe":
+			fmt.Println("Updated pin on boot-environment: " + s.BEName)
+		case "destroybe":
+			fmt.Println("Destroyed boot-environment: " + s.BEName)
+		}
+		os.Exit(0)
+	case "beinfo":
+		var s struct {
+			defines.Envelope
+			BEName   string              `json:"bename"`
+			Manifest *defines.BEManifest `json:"manifest"`
+			DiffBE   string              `json:"diffbe"`
+			Diff     *defines.PkgDiff    `json:"diff"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		if s.Manifest != nil {
+			printmanifest(s.Manifest)
+		} else {
+			fmt.Println("No update manifest in " + s.BEName)
+		}
+		if s.Diff != nil {
+			fmt.Println()
+			fmt.Println("Package changes from " + s.DiffBE + " to " + s.BEName)
+			printdiff(s.Diff)
+		}
+		os.Exit(0)
+	case "cancelstaged":
+		var s struct {
+			defines.Envelope
+			BEName string `json:"bename"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Cancelled staged update: " + s.BEName)
+		os.Exit(0)
+	case "reverttrain":
+		var s struct {
+			defines.Envelope
+			Train string `json:"train"`
+		}
+		if err := json.Unmarshal(message, &s); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Previous package repositories restored")
+		if s.Train != "" {
+			fmt.Println("Train set to: " + s.Train)
+		}
+		os.Exit(0)
 	case "shutdown":
 		var s struct {
 			defines.Envelope
@@ -129,8 +353,9 @@ func parsejsonmsg(message []byte) int {
 }
 
 func StartCheck() {
-	data := map[string]string{
-		"method": "check",
+	data := &defines.SendReq{
+		Method: "check",
+		Only:   defines.OnlyFlag,
 	}
 	msg, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
@@ -158,6 +383,14 @@ func StartCheck() {
 }
 
 func UpdateBootLoader() {
+	// Only report on what would be done
+	if defines.DryRunFlag {
+		sendreq(&defines.SendReq{
+			Method: "bootloaderinfo",
+		})
+		return
+	}
+
 	data := &defines.SendReq{
 		Method: "updatebootloader",
 	}
@@ -190,6 +423,7 @@ func UpdateBootLoader() {
 func ListTrains() {
 	data := &defines.SendReq{
 		Method: "listtrains",
+		Tag:    defines.TagFlag,
 	}
 
 	msg, err := json.Marshal(data)
@@ -219,8 +453,9 @@ func ListTrains() {
 
 func SetTrain() {
 	data := &defines.SendReq{
-		Method: "settrain",
-		Train:  defines.ChangeTrainFlag,
+		Method:  "settrain",
+		Train:   defines.ChangeTrainFlag,
+		Preview: defines.PreviewFlag,
 	}
 
 	msg, err := json.Marshal(data)
@@ -248,6 +483,389 @@ func SetTrain() {
 	}
 }
 
+func CancelReboot() {
+	data := &defines.SendReq{
+		Method: "cancelreboot",
+	}
+
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	//log.Println("JSON Message: ", string(msg))
+	send_err := defines.WSClient.WriteMessage(websocket.TextMessage, msg)
+	if send_err != nil {
+		log.Fatal("Failed talking to WS backend:", send_err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Wait for messages back
+	for {
+		_, message, err := defines.WSClient.ReadMessage()
+		if err != nil {
+			log.Println("read:", err)
+			return
+		}
+		// Do things with the message back
+		parsejsonmsg(message)
+	}
+}
+
+func PruneBEs() {
+	data := &defines.SendReq{
+		Method: "prunebes",
+		DryRun: defines.DryRunFlag,
+	}
+
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	//log.Println("JSON Message: ", string(msg))
+	send_err := defines.WSClient.WriteMessage(websocket.TextMessage, msg)
+	if send_err != nil {
+		log.Fatal("Failed talking to WS backend:", send_err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Wait for messages back
+	for {
+		_, message, err := defines.WSClient.ReadMessage()
+		if err != nil {
+			log.Println("read:", err)
+			return
+		}
+		// Do things with the message back
+		parsejsonmsg(message)
+	}
+}
+
+// Send a request and handle the replies until we are told to exit
+func sendreq(data *defines.SendReq) {
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	send_err := defines.WSClient.WriteMessage(websocket.TextMessage, msg)
+	if send_err != nil {
+		log.Fatal("Failed talking to WS backend:", send_err)
+	}
+
+	// Wait for messages back
+	for {
+		_, message, err := defines.WSClient.ReadMessage()
+		if err != nil {
+			log.Println("read:", err)
+			return
+		}
+		parsejsonmsg(message)
+	}
+}
+
+func BEInfo() {
+	sendreq(&defines.SendReq{
+		Method: "beinfo",
+		Bename: defines.BEInfoFlag,
+		DiffBE: defines.DiffBEFlag,
+	})
+}
+
+func ListBEs() {
+	sendreq(&defines.SendReq{
+		Method: "listbes",
+	})
+}
+
+// Run whichever of the BE management flags was given
+func ManageBE() {
+	data := &defines.SendReq{}
+	switch {
+	case defines.ActivateBEFlag != "":
+		data.Method = "activatebe"
+		data.Bename = defines.ActivateBEFlag
+	case defines.RenameBEFlag != "":
+		if defines.BeNameFlag == "" {
+			log.Fatal("-rename-be requires the new name in -bename")
+		}
+		data.Method = "renamebe"
+		data.Bename = defines.RenameBEFlag
+		data.NewName = defines.BeNameFlag
+	case defines.PinBEFlag != "":
+		data.Method = "pinbe"
+		data.Bename = defines.PinBEFlag
+		data.Pin = true
+	case defines.UnpinBEFlag != "":
+		data.Method = "pinbe"
+		data.Bename = defines.UnpinBEFlag
+	case defines.DestroyBEFlag != "":
+		data.Method = "destroybe"
+		data.Bename = defines.DestroyBEFlag
+	}
+	sendreq(data)
+}
+
+func Status() {
+	data := &defines.SendReq{
+		Method: "status",
+	}
+
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	//log.Println("JSON Message: ", string(msg))
+	send_err := defines.WSClient.WriteMessage(websocket.TextMessage, msg)
+	if send_err != nil {
+		log.Fatal("Failed talking to WS backend:", send_err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Wait for messages back
+	for {
+		_, message, err := defines.WSClient.ReadMessage()
+		if err != nil {
+			log.Println("read:", err)
+			return
+		}
+		// Do things with the message back
+		parsejsonmsg(message)
+	}
+}
+
+func CancelStaged() {
+	data := &defines.SendReq{
+		Method: "cancelstaged",
+	}
+
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	//log.Println("JSON Message: ", string(msg))
+	send_err := defines.WSClient.WriteMessage(websocket.TextMessage, msg)
+	if send_err != nil {
+		log.Fatal("Failed talking to WS backend:", send_err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Wait for messages back
+	for {
+		_, message, err := defines.WSClient.ReadMessage()
+		if err != nil {
+			log.Println("read:", err)
+			return
+		}
+		// Do things with the message back
+		parsejsonmsg(message)
+	}
+}
+
+func RevertTrain() {
+	data := &defines.SendReq{
+		Method: "reverttrain",
+	}
+
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	//log.Println("JSON Message: ", string(msg))
+	send_err := defines.WSClient.WriteMessage(websocket.TextMessage, msg)
+	if send_err != nil {
+		log.Fatal("Failed talking to WS backend:", send_err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Wait for messages back
+	for {
+		_, message, err := defines.WSClient.ReadMessage()
+		if err != nil {
+			log.Println("read:", err)
+			return
+		}
+		// Do things with the message back
+		parsejsonmsg(message)
+	}
+}
+
+// Show the boot-environments and what sysup knows about them
+func printbes(bes []defines.BEInfo) {
+	fmt.Println("Boot-environments:")
+	fmt.Println("----------------------------------------------------")
+	for _, be := range bes {
+		fmt.Printf("%s  %s  %s", be.Name, be.Created, be.Space)
+		if be.Current {
+			fmt.Printf(" [Current]")
+		}
+		if be.NextBoot {
+			fmt.Printf(" [Next Boot]")
+		}
+		if be.Pending {
+			fmt.Printf(" [Pending]")
+		}
+		if be.Pinned {
+			fmt.Printf(" [Pinned]")
+		}
+		fmt.Printf("\n")
+		if be.SysUp {
+			line := "   Updated from: " + be.From
+			if s := be.Summary; s != nil {
+				line += fmt.Sprintf(
+					" (%d updated, %d downgraded, %d new, %d reinstalled,"+
+						" %d removed)",
+					s.Up, s.Down, s.New, s.Reinstall, s.Delete,
+				)
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
+// Show the boot partitions in the pool and what updating them would do
+func printloader(report defines.LoaderReport) {
+	fmt.Println("Boot loader on pool " + report.Pool + ":")
+	fmt.Println("----------------------------------------------------")
+	if report.Error != "" {
+		fmt.Println("Error: " + report.Error)
+	}
+	for _, d := range report.Disks {
+		fmt.Println(d.Disk + "  " + d.Scheme)
+		if d.Error != "" {
+			fmt.Println("   Error: " + d.Error)
+		}
+		for _, p := range d.Partitions {
+			fmt.Printf("   %s  %s  index %d", p.Partition, p.Type, p.Index)
+			if p.Target != "" {
+				fmt.Printf("  %s", p.Target)
+			}
+			if p.UpToDate {
+				fmt.Printf(" [Up to date]")
+			}
+			if p.Result != "" {
+				fmt.Printf(" [%s]", p.Result)
+			}
+			fmt.Printf("\n")
+			if p.Current != nil {
+				fmt.Println(
+					"      Current: " + p.Current.Path + " " +
+						hashorunknown(p.Current.SHA256),
+				)
+			}
+			if p.Staged != nil {
+				fmt.Println(
+					"      Staged:  " + p.Staged.Path + " " +
+						hashorunknown(p.Staged.SHA256),
+				)
+			}
+			fmt.Println("      Action:  " + p.Action)
+			if p.Error != "" {
+				fmt.Println("      Error:   " + p.Error)
+			}
+			if p.BootEntry != "" {
+				fmt.Println("      Boot entry: " + p.BootEntry)
+			}
+			for _, action := range p.BootActions {
+				fmt.Println("      Boot entry action: " + action)
+			}
+			if p.BootError != "" {
+				fmt.Println("      Boot entry error: " + p.BootError)
+			}
+		}
+	}
+	if report.BootNext != "" {
+		fmt.Println("BootNext: " + report.BootNext)
+	}
+	if report.Status != "" {
+		fmt.Println("Status: " + report.Status)
+	}
+}
+
+// Show a missing hash as such, rather than as nothing
+func hashorunknown(hash string) string {
+	if hash == "" {
+		return "(missing)"
+	}
+	return hash
+}
+
+// Show the update which created a boot-environment
+func printmanifest(m *defines.BEManifest) {
+	fmt.Println("Boot-environment: " + m.BEName)
+	fmt.Println("Updated from: " + m.Parent)
+	if m.Train != "" {
+		fmt.Println("Train: " + m.Train)
+	}
+	if m.SysUpVersion != "" {
+		fmt.Println("sysup version: " + m.SysUpVersion)
+	}
+	fmt.Println("Staged: " + m.StagedAt.Format(time.RFC1123))
+	if m.CompletedAt != nil {
+		fmt.Println("Completed: " + m.CompletedAt.Format(time.RFC1123))
+	} else {
+		fmt.Println("Completed: no")
+	}
+	if m.Diff != nil {
+		fmt.Println()
+		printdiff(m.Diff)
+	}
+}
+
+// Show the differences in installed packages
+func printdiff(diff *defines.PkgDiff) {
+	fmt.Println("Changed packages:")
+	fmt.Println("----------------------------------------------------")
+	for _, p := range diff.Changed {
+		fmt.Println("   " + p.Name + " " + p.OldVersion + " -> " + p.NewVersion)
+	}
+	fmt.Println()
+	fmt.Println("Added packages:")
+	fmt.Println("----------------------------------------------------")
+	for _, p := range diff.Added {
+		fmt.Println("   " + p.Name + " " + p.Version)
+	}
+	fmt.Println()
+	fmt.Println("Removed packages:")
+	fmt.Println("----------------------------------------------------")
+	for _, p := range diff.Removed {
+		fmt.Println("   " + p.Name + " " + p.Version)
+	}
+}
+
+// Show an update that is staged and waiting on a reboot
+func printpending(pending *defines.PendingReboot) {
+	if pending == nil {
+		return
+	}
+	fmt.Println("An update is staged in boot-environment " + pending.BEName +
+		" since " + pending.StagedAt.Format(time.RFC1123))
+	if d := pending.Details; d != nil {
+		fmt.Printf(
+			"   %d updated, %d downgraded, %d new, %d reinstalled, %d removed\n",
+			len(d.Up), len(d.Down), len(d.New), len(d.Ri), len(d.Del),
+		)
+	}
+	if pending.Active && pending.RebootAt != nil {
+		fmt.Println("Rebooting at " + pending.RebootAt.Format(time.RFC1123))
+	} else if pending.Active {
+		fmt.Println("Reboot your system to finish the update")
+	} else {
+		fmt.Println("WARNING: " + pending.BEName +
+			" is not the active boot-environment, rebooting will not" +
+			" finish the update")
+	}
+	fmt.Println()
+}
+
 func printupdatedetails(details defines.UpdateInfo) {
 
 	fmt.Println("The following packages will be updated:")
@@ -259,6 +877,19 @@ func printupdatedetails(details defines.UpdateInfo) {
 		)
 	}
 
+	if len(details.Down) > 0 {
+		fmt.Println()
+		fmt.Println("The following packages will be downgraded:")
+		fmt.Println("----------------------------------------------------")
+		for i := range details.Down {
+			fmt.Println(
+				"   " + details.Down[i].Name + " " +
+					details.Down[i].OldVersion + " -> " +
+					details.Down[i].NewVersion,
+			)
+		}
+	}
+
 	fmt.Println()
 	fmt.Println("The following packages will be installed:")
 	fmt.Println("----------------------------------------------------")
@@ -279,6 +910,27 @@ func printupdatedetails(details defines.UpdateInfo) {
 	for i := range details.Del {
 		fmt.Println("   " + details.Del[i].Name + " " + details.Del[i].Version)
 	}
+
+	fmt.Println()
+	if details.Reboot {
+		fmt.Println("A reboot is required to finish this update")
+	} else {
+		fmt.Println("No reboot is required, this update can be applied with -live")
+	}
+
+	if len(details.Held) > 0 {
+		fmt.Println()
+		fmt.Println("The following packages are held:")
+		fmt.Println("----------------------------------------------------")
+		for i := range details.Held {
+			line := "   " + details.Held[i].Name + " " +
+				details.Held[i].Version
+			if details.Held[i].Pin != "" {
+				line += " (pinned to " + details.Held[i].Pin + ")"
+			}
+			fmt.Println(line)
+		}
+	}
 }
 
 func StartUpdate() {
@@ -289,6 +941,9 @@ func StartUpdate() {
 		Bename:     defines.BeNameFlag,
 		Disablebs:  defines.DisableBsFlag,
 		Updatefile: defines.UpdateFileFlag,
+		Only:       defines.OnlyFlag,
+		Live:       defines.LiveFlag,
+		Reboot:     defines.RebootFlag,
 	}
 
 	msg, err := json.Marshal(data)
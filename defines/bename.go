@@ -0,0 +1,121 @@
+package defines
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Template used when the config doesn't set one and the OS version is known
+var DefaultBENameTemplate = "{version}_{date}"
+
+// Date format used by a bare {date} token
+var DefaultBEDateFormat = "%Y-%m-%d-%H-%M-%S"
+
+// Values substituted into a boot-environment name template
+type BENameValues struct {
+	Version string
+	Train   string
+	Date    time.Time
+}
+
+// Format a time using a strftime style format
+func strftime(format string, t time.Time) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return "", errors.New("Date format ends with %: " + format)
+		}
+		switch format[i] {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'j':
+			b.WriteString(t.Format("002"))
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", errors.New(
+				"Unknown date format %" + string(format[i]) + " in: " + format,
+			)
+		}
+	}
+	return b.String(), nil
+}
+
+// Check if a template has a {seq} token to make names unique
+func BENameHasSeq(tmpl string) bool {
+	return strings.Contains(tmpl, "{seq}")
+}
+
+// Expand the tokens in a boot-environment name template
+//
+// Known tokens are {version}, {train}, {date}, {date:FORMAT} with a strftime
+// style FORMAT, and {seq}
+func ExpandBEName(tmpl string, v BENameValues, seq int) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(tmpl, "{")
+		if start < 0 {
+			b.WriteString(tmpl)
+			break
+		}
+		end := strings.Index(tmpl[start:], "}")
+		if end < 0 {
+			return "", errors.New("Unclosed { in boot-environment name template")
+		}
+		end += start
+		b.WriteString(tmpl[:start])
+
+		token := tmpl[start+1 : end]
+		switch {
+		case token == "version":
+			if v.Version == "" {
+				return "", errors.New("No OS version known for {version}")
+			}
+			b.WriteString(v.Version)
+		case token == "train":
+			if v.Train == "" {
+				return "", errors.New("No train known for {train}")
+			}
+			b.WriteString(v.Train)
+		case token == "date" || strings.HasPrefix(token, "date:"):
+			format := DefaultBEDateFormat
+			if token != "date" {
+				format = strings.TrimPrefix(token, "date:")
+			}
+			date, err := strftime(format, v.Date)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(date)
+		case token == "seq":
+			b.WriteString(strconv.Itoa(seq))
+		default:
+			return "", errors.New(
+				"Unknown token {" + token + "} in boot-environment name template",
+			)
+		}
+		tmpl = tmpl[end+1:]
+	}
+	return b.String(), nil
+}
@@ -5,8 +5,22 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// Names we accept for days in the maintenance window
+var Weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
 func LoadConfig() bool {
 	// Try to load the default config file
 	if _, err := os.Stat(ConfigJson); os.IsNotExist(err) {
@@ -31,12 +45,170 @@ func LoadConfig() bool {
 	// Set our gloabls now
 	BootstrapFatal = s.BootstrapFatal
 	TrainsUrl = s.TrainsURL
+	FollowTrains = s.FollowTrains
+	TrainTagPolicy = s.TrainTagPolicy
 
 	// If we have a trains pubkey file specified for verification
 	if s.TrainsPubKey != "" {
 		TrainPubKey = s.TrainsPubKey
 	}
 
+	// Load any extra train sources, each name is also its cache directory
+	// so it has to be unique and can't clash with trainsurl's "default"
+	srcnames := make(map[string]bool)
+	for i := range s.TrainSources {
+		src := &s.TrainSources[i]
+		if src.URL == "" {
+			log.Fatal("Train source missing url in: " + ConfigJson)
+		}
+		if src.Name == "" || strings.ContainsAny(src.Name, "/ ") ||
+			src.Name == "." || src.Name == ".." {
+			log.Fatal("Invalid train source name: \"" + src.Name + "\"")
+		}
+		if src.Name == "default" {
+			log.Fatal("Train source name \"default\" is reserved for trainsurl")
+		}
+		if srcnames[src.Name] {
+			log.Fatal("Duplicate train source name: \"" + src.Name + "\"")
+		}
+		srcnames[src.Name] = true
+		if src.PubKey == "" {
+			src.PubKey = TrainPubKey
+		}
+	}
+	TrainSources = s.TrainSources
+
+	// Validate the repo config patterns we keep between trains
+	for _, pattern := range s.PreserveRepos {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			log.Fatal("Invalid preserverepos pattern: " + pattern)
+		}
+	}
+	PreserveRepos = s.PreserveRepos
+
+	// Replace the default essential packages if the config has its own
+	if s.EssentialPkgs != nil {
+		for _, name := range s.EssentialPkgs {
+			if name == "" || strings.ContainsAny(name, " *?[") {
+				log.Fatal("Invalid essentialpkgs entry: \"" + name + "\"")
+			}
+		}
+		EssentialPkgs = s.EssentialPkgs
+	}
+
+	// Validate the packages we keep back from updates
+	for _, pattern := range s.Holds {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			log.Fatal("Invalid holds pattern: " + pattern)
+		}
+	}
+	Holds = s.Holds
+	for name, pattern := range s.Pins {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			log.Fatal("Invalid pin for " + name + ": " + pattern)
+		}
+	}
+	Pins = s.Pins
+
+	// Validate the automatic schedule now, rather than in the background
+	if s.Schedule != nil {
+		interval, err := time.ParseDuration(s.Schedule.Interval)
+		if err != nil || interval <= 0 {
+			log.Fatal("Invalid schedule interval: " + s.Schedule.Interval)
+		}
+		if s.Schedule.Jitter != "" {
+			jitter, err := time.ParseDuration(s.Schedule.Jitter)
+			if err != nil || jitter < 0 {
+				log.Fatal("Invalid schedule jitter: " + s.Schedule.Jitter)
+			}
+		}
+		w := s.Schedule.Window
+		if w.Start < 0 || w.Start > 23 || w.End < 0 || w.End > 23 {
+			log.Fatal("Invalid schedule window hours, must be 0-23")
+		}
+		for _, day := range w.Days {
+			if _, ok := Weekdays[strings.ToLower(day)]; !ok {
+				log.Fatal("Invalid schedule window day: " + day)
+			}
+		}
+	}
+	Schedule = s.Schedule
+
+	// Replace the default EFI loader paths if the config has its own
+	if s.EFITargets != nil {
+		if len(s.EFITargets) == 0 {
+			log.Fatal("Invalid efitargets, at least one path is needed")
+		}
+		for _, tgt := range s.EFITargets {
+			clean := filepath.Clean(tgt)
+			if tgt == "" || filepath.IsAbs(clean) ||
+				strings.HasPrefix(clean, "..") {
+				log.Fatal("Invalid efitargets entry: \"" + tgt + "\"")
+			}
+		}
+		EFITargets = s.EFITargets
+	}
+
+	if b := s.EFIBoot; b != nil {
+		if b.Label == "" {
+			b.Label = "FreeBSD"
+		}
+		clean := filepath.Clean(b.Loader)
+		if b.Loader != "" && (filepath.IsAbs(clean) ||
+			strings.HasPrefix(clean, "..")) {
+			log.Fatal("Invalid efiboot loader: \"" + b.Loader + "\"")
+		}
+	}
+	EFIBoot = s.EFIBoot
+
+	// Catch bad tokens now, rather than when an update starts
+	if s.BENameTemplate != "" {
+		_, err := ExpandBEName(s.BENameTemplate, BENameValues{
+			Version: "version",
+			Train:   "train",
+			Date:    time.Now(),
+		}, 1)
+		if err != nil {
+			log.Fatal("Invalid benametemplate: " + err.Error())
+		}
+	}
+	BENameTemplate = s.BENameTemplate
+
+	if r := s.BERetention; r != nil {
+		if r.Keep < 0 || r.KeepDays < 0 {
+			log.Fatal("Invalid beretention, values can not be negative")
+		}
+		if r.Keep == 0 && r.KeepDays == 0 {
+			log.Fatal("Invalid beretention, set keep and/or keepdays")
+		}
+	}
+	BERetention = s.BERetention
+
+	// Make sure we know every event we've been asked to notify on
+	for event, target := range s.Notify {
+		known := false
+		for _, e := range NotifyEvents {
+			if e == event {
+				known = true
+				break
+			}
+		}
+		if !known {
+			log.Fatal("Unknown notify event: " + event)
+		}
+		for _, hook := range target.Webhooks {
+			if hook.URL == "" {
+				log.Fatal("Webhook missing url for notify event: " + event)
+			}
+		}
+	}
+	Notify = s.Notify
+
+	// Allow slow or far-away train servers more time
+	if s.TrainsTimeout > 0 {
+		TrainsTimeout = s.TrainsTimeout
+	}
+
 	// Don't update these if already set on the CLI
 	if UpdateKeyFlag != "" {
 		UpdateKeyFlag = s.OfflineUpdateKey
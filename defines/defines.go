@@ -3,8 +3,7 @@ package defines
 import (
 	"flag"
 	"github.com/gorilla/websocket"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +17,10 @@ var pkgflags string
 // What is this tool called?
 var ToolName = "sysup"
 
+// Version of sysup, set at build time with:
+// -ldflags "-X github.com/trueos/sysup/defines.Version=<version>"
+var Version string
+
 // Where to log by default
 var LogFile = "/var/log/" + ToolName + ".log"
 
@@ -27,6 +30,9 @@ var ConfigJson = "/usr/local/etc/" + ToolName + ".json"
 // Global trains URL
 var TrainsUrl string
 
+// Additional sources of trains, merged with TrainsUrl by priority
+var TrainSources []TrainSource
+
 // Default kernel pkg name
 var KernelPkg string
 
@@ -40,6 +46,9 @@ var BootstrapFatal = false
 // Default pubkey used for trains
 var TrainPubKey = "/usr/local/share/" + ToolName + "/trains.pub"
 
+// Timeout (in seconds) when fetching the trains manifest
+var TrainsTimeout = 30
+
 // Package defaults
 //----------------------------------------------------
 var PKGBIN = "pkg-static"
@@ -49,9 +58,104 @@ var PkgDb = SysUpDb + "/pkgdb"
 var ImgMnt = SysUpDb + "/mnt"
 var PkgConf = SysUpDb + "/pkg.conf"
 var CacheDir = SysUpDb + "/cache"
+var TrainsCache = SysUpDb + "/trains"
 var MdDev = ""
 var AbiOverride = ""
 
+// Alternative REPOS_DIR for our pkg config, used to preview other trains
+var ReposDir = ""
+
+// Persistent state which should not move with -cachedir
+var StateDir = "/var/db/" + ToolName
+var TrainBackupDir = StateDir + "/train-backup"
+
+// Package repository configuration
+var PkgConfDir = "/etc/pkg"
+var TrainConf = PkgConfDir + "/Train.conf"
+var TrainPkgKey = "/usr/share/keys/train-pkg.key"
+
+// Repo config files (globs) in PkgConfDir left alone when changing trains
+var PreserveRepos []string
+
+// Automatically move off deprecated trains to their replacement
+var FollowTrains = false
+
+// If set, only trains with at least one of these tags may be selected
+var TrainTagPolicy []string
+
+// Package names or glob patterns which must not be changed by updates
+var Holds []string
+
+// Packages marked as non-automatic after updates so autoremove keeps them
+var EssentialPkgs = []string{
+	"ports-mgmt/pkg",
+	"os/userland",
+	"os/kernel",
+	"sysutils/openzfs",
+}
+
+// Packages which may only be updated to a version matching the glob pattern
+var Pins map[string]string
+
+// Automatic check / update schedule for websocket mode, nil if disabled
+var Schedule *ScheduleConfig
+var ScheduleState = StateDir + "/schedule.json"
+
+// Loader files on the EFI partition to replace, relative to its root
+var EFITargets = []string{
+	"efi/freebsd/loader.efi",
+	"efi/boot/bootx64-trueos.efi",
+}
+
+// Removable media loader, which may belong to another OS on a shared EFI
+// partition, so only replaced if listed in EFITargets or known to be ours
+var EFIFallback = "efi/boot/bootx64.efi"
+
+// Marks EFIFallback as a FreeBSD loader
+var EFIFallbackMarker = "efi/boot/bootx64-trueos.efi"
+
+// Firmware boot entries to keep pointing at the EFI loader, nil to leave
+// them alone
+var EFIBoot *EFIBootConfig
+
+// Template for naming new boot-environments, empty for the default
+var BENameTemplate string
+
+// Old boot-environments to keep, nil to never prune them
+var BERetention *RetentionConfig
+
+// Notifications to send for each event type
+var Notify map[string]NotifyTarget
+
+// Notifications waiting for the network, kept on a dataset shared by all
+// boot-environments so they survive a failed stage 2
+var NotifySpool = "/var/log/" + ToolName + "-notify"
+
+// What each event was last sent about, so repeated checks don't resend it
+var NotifyState = StateDir + "/notify.json"
+
+// Events we send notifications for
+var NotifyEvents = []string{"updatefound", "staged", "failed", "completed"}
+
+// Directory with a sub-directory of hook scripts for each update phase
+var HooksDir = "/usr/local/etc/" + ToolName + ".d"
+
+// Details of the staged update, kept in the root of the new BE
+var StageState = "/.updategostate"
+
+// What a BE contains relative to its parent, kept in the root of each BE
+var BEManifestFile = "/.sysup-manifest.json"
+
+// Details of the finished update, waiting for the post-boot hooks
+var PostBootState = StateDir + "/postboot.json"
+
+// Update staged into a new boot-environment, waiting on a reboot
+var PendingState = StateDir + "/pending.json"
+
+// Held while checking or updating so the scheduler and clients don't
+// run pkg operations at the same time
+var OpLock sync.Mutex
+
 //----------------------------------------------------
 
 // Boot-Environment defaults
@@ -59,15 +163,8 @@ var AbiOverride = ""
 var BEBIN = "beadm"
 var curDate = time.Now()
 
-// We want the int representations of these
-var BESTAGE = strings.Join([]string{
-	strconv.Itoa(curDate.Year()),
-	strconv.Itoa(int(curDate.Month())),
-	strconv.Itoa(curDate.Day()),
-	strconv.Itoa(curDate.Hour()),
-	strconv.Itoa(curDate.Minute()),
-	strconv.Itoa(curDate.Second()),
-}, "-")
+// Zero-padded so the names sort by date
+var BESTAGE = curDate.Format("2006-01-02-15-04-05")
 
 var STAGEDIR = "/.updatestage"
 
@@ -78,11 +175,18 @@ var STAGEDIR = "/.updatestage"
 var BeNameFlag string
 var BootloaderFlag bool
 var ChangeTrainFlag string
+var PreviewFlag bool
 var CheckFlag bool
 var DisableBsFlag bool
 var FullUpdateFlag bool
+var OnlyFlag string
 var ListTrainFlag bool
+var TagFlag string
+var RevertTrainFlag bool
+var StatusFlag bool
+var CancelStagedFlag bool
 var Stage2Flag bool
+var PostBootFlag bool
 var UpdateFlag bool
 var UpdateFileFlag string
 var UpdateKeyFlag string
@@ -92,6 +196,19 @@ var WebsocketIP string
 var WebsocketPort int
 var WebsocketAddr string
 var FetchOnlyFlag bool
+var LiveFlag bool
+var RebootFlag string
+var CancelRebootFlag bool
+var PruneBEsFlag bool
+var ListBEsFlag bool
+var ActivateBEFlag string
+var RenameBEFlag string
+var PinBEFlag string
+var UnpinBEFlag string
+var DestroyBEFlag string
+var BEInfoFlag string
+var DiffBEFlag string
+var DryRunFlag bool
 
 func init() {
 	flag.BoolVar(
@@ -119,18 +236,56 @@ func init() {
 		false,
 		"List available trains (if configured)",
 	)
+	flag.StringVar(
+		&TagFlag,
+		"tag",
+		"",
+		"Only list trains with the specified tag(s), comma separated",
+	)
 	flag.StringVar(
 		&ChangeTrainFlag,
 		"change-train",
 		"",
 		"Change to the specified new train",
 	)
+	flag.BoolVar(
+		&PreviewFlag,
+		"preview",
+		false,
+		"With -change-train, show the package changes without changing trains",
+	)
+	flag.BoolVar(
+		&RevertTrainFlag,
+		"revert-train",
+		false,
+		"Restore the package repositories from before the last train change",
+	)
+	flag.BoolVar(
+		&StatusFlag,
+		"status",
+		false,
+		"Show if an update is staged and waiting on a reboot",
+	)
+	flag.BoolVar(
+		&CancelStagedFlag,
+		"cancel-staged",
+		false,
+		"Discard the staged update and keep booting the current"+
+			" boot-environment",
+	)
 	flag.BoolVar(
 		&FullUpdateFlag,
 		"fullupdate",
 		false,
 		"Force a full update",
 	)
+	flag.StringVar(
+		&OnlyFlag,
+		"only",
+		"",
+		"Only check or update the specified package(s) and their"+
+			" dependencies, comma separated",
+	)
 	flag.BoolVar(
 		&BootloaderFlag,
 		"updatebootloader",
@@ -156,6 +311,12 @@ func init() {
 		false,
 		"Start 2nd stage of updating, normally only run internally by sysup",
 	)
+	flag.BoolVar(
+		&PostBootFlag,
+		"postboot",
+		false,
+		"Finish an update after booting, normally only run internally by sysup",
+	)
 	flag.StringVar(
 		&BeNameFlag,
 		"bename",
@@ -187,14 +348,92 @@ func init() {
 		8134,
 		"Port to use when in server mode",
 	)
+	flag.BoolVar(
+		&LiveFlag,
+		"live",
+		false,
+		"Apply updates to the running system without a new boot-environment,"+
+			" only if no reboot is needed",
+	)
+	flag.StringVar(
+		&RebootFlag,
+		"reboot",
+		"",
+		"Reboot after staging the update: now, at=HH:MM or window",
+	)
+	flag.BoolVar(
+		&CancelRebootFlag,
+		"cancel-reboot",
+		false,
+		"Cancel a reboot scheduled by -reboot",
+	)
+	flag.BoolVar(
+		&ListBEsFlag,
+		"list-bes",
+		false,
+		"List boot-environments along with their update details",
+	)
+	flag.StringVar(
+		&ActivateBEFlag,
+		"activate-be",
+		"",
+		"Boot the specified boot-environment on the next reboot",
+	)
+	flag.StringVar(
+		&RenameBEFlag,
+		"rename-be",
+		"",
+		"Rename the specified boot-environment to the name given by -bename",
+	)
+	flag.StringVar(
+		&PinBEFlag,
+		"pin-be",
+		"",
+		"Keep the specified boot-environment from being pruned or destroyed",
+	)
+	flag.StringVar(
+		&UnpinBEFlag,
+		"unpin-be",
+		"",
+		"Allow the specified boot-environment to be pruned again",
+	)
+	flag.StringVar(
+		&DestroyBEFlag,
+		"destroy-be",
+		"",
+		"Destroy the specified boot-environment",
+	)
+	flag.StringVar(
+		&BEInfoFlag,
+		"be-info",
+		"",
+		"Show the update manifest of the specified boot-environment",
+	)
+	flag.StringVar(
+		&DiffBEFlag,
+		"diff-be",
+		"",
+		"With -be-info, show the package differences to this"+
+			" boot-environment",
+	)
+	flag.BoolVar(
+		&PruneBEsFlag,
+		"prune-bes",
+		false,
+		"Destroy old boot-environments according to the retention policy",
+	)
+	flag.BoolVar(
+		&DryRunFlag,
+		"dry-run",
+		false,
+		"Show what would be done without making any changes",
+	)
 	flag.BoolVar(
 		&FetchOnlyFlag,
 		"fetch-only",
 		false,
 		"Instruct update to only fetch the updates, not apply them.",
 	)
-
-	flag.Parse()
 }
 
 func SetLocs() {
@@ -208,7 +447,7 @@ func SetLocs() {
 	ImgMnt = SysUpDb + "/mnt"
 	PkgConf = SysUpDb + "/pkg.conf"
 	CacheDir = SysUpDb + "/cache"
-
+	TrainsCache = SysUpDb + "/trains"
 }
 
 // Define all our JSON structures
@@ -234,14 +473,94 @@ type DelPkg struct {
 	Version string `json:"Version"`
 }
 
+// Package kept at its installed version by a hold or pin
+type HeldPkg struct {
+	Name    string `json:"name"`
+	Version string `json:"Version"`
+	Pin     string `json:"pin,omitempty"`
+}
+
 // Local configuration file
 type ConfigFile struct {
-	Bootstrap        bool   `json:"bootstrap"`
-	BootstrapFatal   bool   `json:"bootstrapfatal"`
-	CacheDir         string `json:"cachedir"`
-	OfflineUpdateKey string `json:"offlineupdatekey"`
-	TrainsURL        string `json:"trainsurl"`
-	TrainsPubKey     string `json:"trainspubkey"`
+	Bootstrap        bool                    `json:"bootstrap"`
+	BootstrapFatal   bool                    `json:"bootstrapfatal"`
+	CacheDir         string                  `json:"cachedir"`
+	OfflineUpdateKey string                  `json:"offlineupdatekey"`
+	TrainsURL        string                  `json:"trainsurl"`
+	TrainsPubKey     string                  `json:"trainspubkey"`
+	TrainsTimeout    int                     `json:"trainstimeout"`
+	TrainSources     []TrainSource           `json:"trainsources"`
+	PreserveRepos    []string                `json:"preserverepos"`
+	FollowTrains     bool                    `json:"followtrains"`
+	TrainTagPolicy   []string                `json:"traintagpolicy"`
+	EssentialPkgs    []string                `json:"essentialpkgs"`
+	Holds            []string                `json:"holds"`
+	Pins             map[string]string       `json:"pins"`
+	Schedule         *ScheduleConfig         `json:"schedule"`
+	BERetention      *RetentionConfig        `json:"beretention"`
+	BENameTemplate   string                  `json:"benametemplate"`
+	EFITargets       []string                `json:"efitargets"`
+	EFIBoot          *EFIBootConfig          `json:"efiboot"`
+	Notify           map[string]NotifyTarget `json:"notify"`
+}
+
+// Where to send notifications for an event
+type NotifyTarget struct {
+	Webhooks []Webhook `json:"webhooks"`
+	Scripts  []string  `json:"scripts"`
+}
+
+// HTTP endpoint which gets event JSON POSTed to it, signed with an
+// HMAC-SHA256 of the body if a secret is set
+type Webhook struct {
+	URL     string `json:"url"`
+	Secret  string `json:"secret"`
+	Retries int    `json:"retries"`
+	Timeout int    `json:"timeout"`
+}
+
+// How many of the boot-environments sysup created to keep. A BE is kept if
+// it is one of the newest Keep or is younger than KeepDays.
+type RetentionConfig struct {
+	Keep     int `json:"keep"`
+	KeepDays int `json:"keepdays"`
+}
+
+// How to manage the firmware boot entries with efibootmgr
+type EFIBootConfig struct {
+	Label string `json:"label"`
+	// Loader on the EFI partition the entry boots, relative to its root
+	Loader          string `json:"loader"`
+	BootNext        bool   `json:"bootnext"`
+	DeactivateStale bool   `json:"deactivatestale"`
+}
+
+// Automatic checks and updates when running with -websocket
+type ScheduleConfig struct {
+	// How often to check, and the max random delay added to spread a fleet
+	Interval string `json:"interval"`
+	Jitter   string `json:"jitter"`
+	// When we are allowed to stage updates
+	Window MaintWindow `json:"window"`
+	// Download updates when found / stage them in the maintenance window
+	AutoFetch bool `json:"autofetch"`
+	AutoStage bool `json:"autostage"`
+}
+
+// Days (mon, tue...) and hours (0-23) we may stage updates in. No days means
+// every day, and equal start / end hours means the whole day.
+type MaintWindow struct {
+	Days  []string `json:"days"`
+	Start int      `json:"start"`
+	End   int      `json:"end"`
+}
+
+// Remote trains manifest and the key used to verify it
+type TrainSource struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	PubKey   string `json:"pubkey"`
+	Priority int    `json:"priority"`
 }
 
 type Envelope struct {
@@ -255,6 +574,7 @@ type Envelope struct {
 type Check struct {
 	Updates bool
 	Details UpdateInfo
+	Pending *PendingReboot
 }
 
 // Return informational message
@@ -262,6 +582,13 @@ type InfoMsg struct {
 	Info string
 }
 
+// Event sent when the current train has been deprecated
+type TrainDeprecated struct {
+	Train    string `json:"train"`
+	NewTrain string `json:"newtrain"`
+	Follow   bool   `json:"follow"`
+}
+
 // Train Def
 type TrainDef struct {
 	Description string   `json:"description"`
@@ -273,24 +600,162 @@ type TrainDef struct {
 	Tags        []string `json:"tags"`
 	Version     int      `json:"version"`
 	Current     bool     `json:"current"`
+	Source      string   `json:"source"`
+	Essential   []string `json:"essential"`
+	// Optional requirements the host must meet to use this train
+	MinSysUpVersion string   `json:"minsysupversion"`
+	ABIs            []string `json:"abis"`
+	Arches          []string `json:"arches"`
+	Flavor          string   `json:"flavor"`
+	// Set by sysup when the host doesn't meet the above
+	Incompatible string `json:"incompatible"`
 }
 
 // Trains Top Level
 type TrainsDef struct {
 	Trains  []TrainDef `json:"trains"`
 	Default string     `json:"default"`
+	Stale   bool       `json:"stale"`
+	Fetched string     `json:"fetched"`
+	// Names of the sources we could only load from cache
+	StaleSources []string `json:"stalesources"`
 }
 
 // Update information we return to API requests
 type UpdateInfo struct {
-	New       []NewPkg `json:"new"`
-	Up        []UpPkg  `json:"update"`
-	Ri        []RiPkg  `json:"reinstall"`
-	Del       []DelPkg `json:"delete"`
-	KernelUp  bool     `json:"kernelup"`
-	KernelPkg string   `json:"kernelpkg"`
-	SysUp     bool     `json:"sysup"`
-	SysUpPkg  string   `json:"sysuppkg"`
+	New       []NewPkg  `json:"new"`
+	Up        []UpPkg   `json:"update"`
+	Down      []UpPkg   `json:"downgrade"`
+	Ri        []RiPkg   `json:"reinstall"`
+	Del       []DelPkg  `json:"delete"`
+	Held      []HeldPkg `json:"held"`
+	KernelUp  bool      `json:"kernelup"`
+	KernelPkg string    `json:"kernelpkg"`
+	SysUp     bool      `json:"sysup"`
+	SysUpPkg  string    `json:"sysuppkg"`
+	Reboot    bool      `json:"reboot"`
+
+	// Packages sysup locked to keep them held, unlocked after the update
+	Locked []string `json:"locked,omitempty"`
+}
+
+// Update staged into a new boot-environment
+type StageInfo struct {
+	BEName     string      `json:"bename"`
+	OldBEName  string      `json:"oldbename"`
+	KernelUp   bool        `json:"kernelup"`
+	FullUpdate bool        `json:"fullupdate"`
+	Details    *UpdateInfo `json:"details"`
+	Essential  []string    `json:"essential"`
+	Only       string      `json:"only"`
+	StagedAt   time.Time   `json:"stagedat"`
+	// Boot loader settings, stage 2 runs before the config is loaded
+	EFITargets []string       `json:"efitargets,omitempty"`
+	EFIBoot    *EFIBootConfig `json:"efiboot,omitempty"`
+	// How updating the boot loader went in stage 2
+	Loader *LoaderReport `json:"loader,omitempty"`
+}
+
+// Staged update which is waiting on a reboot to finish
+type PendingReboot struct {
+	StageInfo
+	// Set if the staged boot-environment is the one used on the next boot
+	Active bool `json:"active"`
+	// When the reboot scheduled with -reboot will happen
+	RebootAt *time.Time `json:"rebootat,omitempty"`
+}
+
+// Counts of the package changes made by an update
+type PkgSummary struct {
+	Up        int `json:"update"`
+	Down      int `json:"downgrade"`
+	New       int `json:"new"`
+	Reinstall int `json:"reinstall"`
+	Delete    int `json:"delete"`
+}
+
+// Installed package changes between two sets of packages
+type PkgDiff struct {
+	Added   []NewPkg `json:"added"`
+	Removed []DelPkg `json:"removed"`
+	Changed []UpPkg  `json:"changed"`
+}
+
+// Record of the update which created a boot-environment
+type BEManifest struct {
+	BEName       string      `json:"bename"`
+	Parent       string      `json:"parent"`
+	Train        string      `json:"train"`
+	SysUpVersion string      `json:"sysupversion"`
+	Details      *UpdateInfo `json:"details"`
+	StagedAt     time.Time   `json:"stagedat"`
+	CompletedAt  *time.Time  `json:"completedat,omitempty"`
+	// Final changes to the installed packages, set once stage 2 finishes
+	Diff *PkgDiff `json:"diff,omitempty"`
+	// Packages installed in the parent, only kept until the diff is made
+	ParentPkgs map[string]string `json:"parentpkgs,omitempty"`
+}
+
+// A boot loader file and its SHA256
+type LoaderFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Boot partition and what updating it would do, or did
+type BootPart struct {
+	Partition string `json:"partition"`
+	Index     int    `json:"index"`
+	Type      string `json:"type"`
+	// Loader installed now, and the one which would replace it
+	Current  *LoaderFile `json:"current,omitempty"`
+	Staged   *LoaderFile `json:"staged,omitempty"`
+	UpToDate bool        `json:"uptodate"`
+	Action   string      `json:"action"`
+	// Loader file replaced on an EFI partition
+	Target string `json:"target,omitempty"`
+	// "updated", "uptodate" or "failed", empty for a dry-run
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Firmware boot entry for the loader, and what was done to it
+	BootEntry   string   `json:"bootentry,omitempty"`
+	BootActions []string `json:"bootactions,omitempty"`
+	BootError   string   `json:"booterror,omitempty"`
+}
+
+// Disk in the pool and its boot partitions
+type BootDisk struct {
+	Disk       string     `json:"disk"`
+	Scheme     string     `json:"scheme"`
+	Partitions []BootPart `json:"partitions"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Boot loader inventory of the pool we boot from
+type LoaderReport struct {
+	Pool  string     `json:"pool"`
+	Disks []BootDisk `json:"disks"`
+	// "ok", "partial" or "failed" once the loaders are updated
+	Status string `json:"status,omitempty"`
+	// Boot entry set to be tried once on the next boot
+	BootNext string `json:"bootnext,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Boot-environment along with what sysup knows about it
+type BEInfo struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+	Space      string `json:"space"`
+	Created    string `json:"created"`
+	Current    bool   `json:"current"`
+	NextBoot   bool   `json:"nextboot"`
+	Pending    bool   `json:"pending"`
+	Pinned     bool   `json:"pinned"`
+	// Only set for BEs sysup created
+	SysUp   bool        `json:"sysup"`
+	From    string      `json:"from,omitempty"`
+	Summary *PkgSummary `json:"summary,omitempty"`
 }
 
 // Incoming JSON API Requests
@@ -305,9 +770,18 @@ type SendReq struct {
 	Fullupdate bool   `json:"fullupdate"`
 	Cachedir   string `json:"cachedir"`
 	Train      string `json:"train"`
+	Tag        string `json:"tag"`
+	Preview    bool   `json:"preview"`
 	Updatefile string `json:"updatefile"`
 	Updatekey  string `json:"updatekey"`
 	Fetchonly  bool   `json:"fetchonly"`
+	Only       string `json:"only"`
+	Live       bool   `json:"live"`
+	Reboot     string `json:"reboot"`
+	DryRun     bool   `json:"dryrun"`
+	NewName    string `json:"newname"`
+	Pin        bool   `json:"pin"`
+	DiffBE     string `json:"diffbe"`
 }
 
 //----------------------------------------------------
@@ -0,0 +1,46 @@
+package defines
+
+import (
+	"strings"
+	"time"
+)
+
+// Check if a time falls inside the maintenance window
+func (w MaintWindow) Contains(t time.Time) bool {
+	if len(w.Days) > 0 {
+		found := false
+		for _, day := range w.Days {
+			if Weekdays[strings.ToLower(day)] == t.Weekday() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	hour := t.Hour()
+	switch {
+	case w.Start == w.End:
+		return true
+	case w.Start < w.End:
+		return hour >= w.Start && hour < w.End
+	default:
+		// Window wraps past midnight
+		return hour >= w.Start || hour < w.End
+	}
+}
+
+// Get the next hour after t which starts inside the window, or the zero time
+// if the window never opens
+func (w MaintWindow) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Hour)
+	for i := 0; i <= 24*8; i++ {
+		t = t.Add(time.Hour)
+		if w.Contains(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
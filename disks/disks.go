@@ -0,0 +1,243 @@
+package disks
+
+import (
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Partition of a disk, as seen by the GEOM PART class
+type Partition struct {
+	// Device name, such as "ada0p1" or "diskid/DISK-1234p1"
+	Name    string `json:"name"`
+	Index   int    `json:"index"`
+	Type    string `json:"type"`
+	Label   string `json:"label,omitempty"`
+	RawUUID string `json:"rawuuid,omitempty"`
+	Size    int64  `json:"size"`
+	// Other names for the partition, such as "gpt/boot0" and "gptid/..."
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// Device node of the partition
+func (p Partition) Dev() string {
+	return "/dev/" + p.Name
+}
+
+// Check if the partition holds boot code or an EFI system partition
+func (p Partition) IsBoot() bool {
+	return p.Type == "efi" || p.Type == "freebsd-boot"
+}
+
+// Disk with a partition table
+type Disk struct {
+	// Name of the partitioned device, which may be a disk, diskid label,
+	// multipath or gmirror device
+	Name       string      `json:"name"`
+	Scheme     string      `json:"scheme"`
+	Partitions []Partition `json:"partitions"`
+	// Physical disks under the device, more than one for multipath and
+	// gmirror devices
+	Physical []string `json:"physical"`
+}
+
+// Get the efi and freebsd-boot partitions of the disk, in index order
+func (d Disk) BootPartitions() []Partition {
+	var parts []Partition
+	for _, p := range d.Partitions {
+		if p.IsBoot() {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// Layout of kern.geom.confxml
+type xmlMesh struct {
+	Classes []xmlClass `xml:"class"`
+}
+
+type xmlClass struct {
+	Name  string    `xml:"name"`
+	Geoms []xmlGeom `xml:"geom"`
+}
+
+type xmlGeom struct {
+	ID        string        `xml:"id,attr"`
+	Name      string        `xml:"name"`
+	Scheme    string        `xml:"config>scheme"`
+	Consumers []xmlConsumer `xml:"consumer"`
+	Providers []xmlProvider `xml:"provider"`
+}
+
+type xmlConsumer struct {
+	Provider struct {
+		Ref string `xml:"ref,attr"`
+	} `xml:"provider"`
+}
+
+type xmlProvider struct {
+	ID        string `xml:"id,attr"`
+	Name      string `xml:"name"`
+	Mediasize int64  `xml:"mediasize"`
+	Index     int    `xml:"config>index"`
+	Type      string `xml:"config>type"`
+	Label     string `xml:"config>label"`
+	RawUUID   string `xml:"config>rawuuid"`
+}
+
+type geom struct {
+	class     string
+	name      string
+	scheme    string
+	consumers []string
+	providers []*provider
+}
+
+type provider struct {
+	xmlProvider
+	geom *geom
+}
+
+// GEOM topology of the system
+type Topology struct {
+	providers map[string]*provider
+	byname    map[string]*provider
+	geoms     []*geom
+}
+
+// Load the GEOM topology of the running system
+func Load() (*Topology, error) {
+	conf, err := syscall.Sysctl("kern.geom.confxml")
+	if err != nil {
+		return nil, errors.New("Failed getting kern.geom.confxml")
+	}
+	return Parse([]byte(conf))
+}
+
+// Parse a kern.geom.confxml document
+func Parse(data []byte) (*Topology, error) {
+	var mesh xmlMesh
+	if err := xml.Unmarshal(data, &mesh); err != nil {
+		return nil, errors.New("Failed parsing GEOM config: " + err.Error())
+	}
+
+	t := &Topology{
+		providers: make(map[string]*provider),
+		byname:    make(map[string]*provider),
+	}
+	for _, c := range mesh.Classes {
+		for _, xg := range c.Geoms {
+			g := &geom{class: c.Name, name: xg.Name, scheme: xg.Scheme}
+			for _, xc := range xg.Consumers {
+				g.consumers = append(g.consumers, xc.Provider.Ref)
+			}
+			for _, xp := range xg.Providers {
+				p := &provider{xmlProvider: xp, geom: g}
+				g.providers = append(g.providers, p)
+				t.providers[xp.ID] = p
+				t.byname[xp.Name] = p
+			}
+			t.geoms = append(t.geoms, g)
+		}
+	}
+	return t, nil
+}
+
+// Get the names of the labels stacked directly on a provider
+func (t *Topology) aliases(p *provider) []string {
+	var names []string
+	for _, g := range t.geoms {
+		if g.class != "LABEL" || len(g.consumers) != 1 ||
+			g.consumers[0] != p.ID {
+			continue
+		}
+		for _, lp := range g.providers {
+			names = append(names, lp.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get the physical disks under a geom
+func (t *Topology) physical(g *geom, depth int) []string {
+	if g.class == "DISK" {
+		var names []string
+		for _, p := range g.providers {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+	if depth > 16 {
+		return nil
+	}
+	var names []string
+	for _, ref := range g.consumers {
+		if p, ok := t.providers[ref]; ok {
+			names = append(names, t.physical(p.geom, depth+1)...)
+		}
+	}
+	return names
+}
+
+// Build the disk for a PART geom
+func (t *Topology) disk(g *geom) Disk {
+	d := Disk{Name: g.name, Scheme: g.scheme, Physical: t.physical(g, 0)}
+	for _, p := range g.providers {
+		d.Partitions = append(d.Partitions, Partition{
+			Name:    p.Name,
+			Index:   p.Index,
+			Type:    p.Type,
+			Label:   p.Label,
+			RawUUID: p.RawUUID,
+			Size:    p.Mediasize,
+			Aliases: t.aliases(p),
+		})
+	}
+	sort.Slice(d.Partitions, func(i, j int) bool {
+		return d.Partitions[i].Index < d.Partitions[j].Index
+	})
+	return d
+}
+
+// Get a partitioned disk by name
+func (t *Topology) Disk(name string) (Disk, bool) {
+	for _, g := range t.geoms {
+		if g.class == "PART" && g.name == name {
+			return t.disk(g), true
+		}
+	}
+	return Disk{}, false
+}
+
+// Find the partitioned disk a device lives on
+//
+// The device may be a partition by any of its names ("ada0p3", "gpt/zfs0",
+// "gptid/...", "diskid/DISK-1234p3") or something stacked on one, such as a
+// geli provider
+func (t *Topology) DiskOf(dev string) (Disk, error) {
+	name := strings.TrimPrefix(dev, "/dev/")
+	p, ok := t.byname[name]
+	if !ok {
+		return Disk{}, errors.New("Unknown device: " + dev)
+	}
+
+	// Walk down through labels and the like until we reach a partition
+	for depth := 0; depth <= 16; depth++ {
+		if p.geom.class == "PART" {
+			return t.disk(p.geom), nil
+		}
+		if len(p.geom.consumers) != 1 {
+			break
+		}
+		next, ok := t.providers[p.geom.consumers[0]]
+		if !ok {
+			break
+		}
+		p = next
+	}
+	return Disk{}, errors.New("Device is not on a partitioned disk: " + dev)
+}
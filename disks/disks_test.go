@@ -0,0 +1,232 @@
+package disks
+
+import (
+	"github.com/trueos/sysup/internal/testlog"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	testlog.Run(m)
+}
+
+// Load a kern.geom.confxml fixture from testdata
+func loadfixture(t *testing.T, name string) *Topology {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return topo
+}
+
+func partnames(parts []Partition) []string {
+	var names []string
+	for _, p := range parts {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := Parse([]byte("<mesh><class>")); err == nil {
+		t.Fatal("parsed truncated XML")
+	}
+}
+
+func TestParse(t *testing.T) {
+	topo := loadfixture(t, "mirror.xml")
+
+	d, ok := topo.Disk("ada0")
+	if !ok {
+		t.Fatal("disk ada0 not found")
+	}
+	if d.Scheme != "GPT" {
+		t.Errorf("scheme = %q, want GPT", d.Scheme)
+	}
+	if want := []string{"ada0"}; !reflect.DeepEqual(d.Physical, want) {
+		t.Errorf("physical = %v, want %v", d.Physical, want)
+	}
+	want := []string{"ada0p1", "ada0p2", "ada0p3", "ada0p4"}
+	if got := partnames(d.Partitions); !reflect.DeepEqual(got, want) {
+		t.Fatalf("partitions = %v, want %v", got, want)
+	}
+
+	efi := d.Partitions[1]
+	if efi.Index != 2 || efi.Type != "efi" || efi.Label != "efiboot0" ||
+		efi.Size != 209715200 {
+		t.Errorf("efi partition = %+v", efi)
+	}
+	if efi.RawUUID != "d993f762-659a-5713-8e5c-cd9b1ee9f8fa" {
+		t.Errorf("efi rawuuid = %q", efi.RawUUID)
+	}
+	aliases := []string{
+		"gpt/efiboot0", "gptid/d993f762-659a-5713-8e5c-cd9b1ee9f8fa",
+	}
+	if !reflect.DeepEqual(efi.Aliases, aliases) {
+		t.Errorf("efi aliases = %v, want %v", efi.Aliases, aliases)
+	}
+	if efi.Dev() != "/dev/ada0p2" {
+		t.Errorf("efi dev = %q", efi.Dev())
+	}
+
+	want = []string{"ada0p1", "ada0p2"}
+	if got := partnames(d.BootPartitions()); !reflect.DeepEqual(got, want) {
+		t.Errorf("boot partitions = %v, want %v", got, want)
+	}
+
+	if _, ok := topo.Disk("ada0p4"); ok {
+		t.Error("found a partition as a disk")
+	}
+}
+
+func TestDiskOf(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		dev      string
+		disk     string
+		physical []string
+		boot     []string
+	}{
+		{
+			"mirror.xml", "/dev/ada0p4", "ada0", []string{"ada0"},
+			[]string{"ada0p1", "ada0p2"},
+		},
+		{
+			"mirror.xml", "/dev/gpt/zfs1", "ada1", []string{"ada1"},
+			[]string{"ada1p1", "ada1p2"},
+		},
+		{
+			"mirror.xml", "gptid/68f18b39-e88b-52bb-a099-4740c04f0bd7",
+			"ada0", []string{"ada0"}, []string{"ada0p1", "ada0p2"},
+		},
+		{
+			"diskid.xml", "/dev/diskid/DISK-S3Z1NB0K100001Ap4",
+			"diskid/DISK-S3Z1NB0K100001A", []string{"ada0"},
+			[]string{
+				"diskid/DISK-S3Z1NB0K100001Ap1",
+				"diskid/DISK-S3Z1NB0K100001Ap2",
+			},
+		},
+		{
+			"multipath.xml", "/dev/gpt/zfs0", "multipath/disk1",
+			[]string{"da0", "da1"},
+			[]string{"multipath/disk1p1", "multipath/disk1p2"},
+		},
+		{
+			"gmirror.xml", "/dev/mirror/gm0p4", "mirror/gm0",
+			[]string{"ada0", "ada1"},
+			[]string{"mirror/gm0p1", "mirror/gm0p2"},
+		},
+		{
+			"geli.xml", "/dev/ada0p4.eli", "ada0", []string{"ada0"},
+			[]string{"ada0p1", "ada0p2"},
+		},
+		{
+			"geli.xml", "/dev/gpt/zfs1.eli", "ada1", []string{"ada1"},
+			[]string{"ada1p1", "ada1p2"},
+		},
+	}
+	for _, test := range tests {
+		topo := loadfixture(t, test.fixture)
+		d, err := topo.DiskOf(test.dev)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.fixture, test.dev, err)
+			continue
+		}
+		if d.Name != test.disk {
+			t.Errorf("%s %s: disk = %q, want %q",
+				test.fixture, test.dev, d.Name, test.disk)
+		}
+		if !reflect.DeepEqual(d.Physical, test.physical) {
+			t.Errorf("%s %s: physical = %v, want %v",
+				test.fixture, test.dev, d.Physical, test.physical)
+		}
+		if got := partnames(d.BootPartitions()); !reflect.DeepEqual(
+			got, test.boot,
+		) {
+			t.Errorf("%s %s: boot partitions = %v, want %v",
+				test.fixture, test.dev, got, test.boot)
+		}
+	}
+}
+
+func TestDiskOfErrors(t *testing.T) {
+	tests := []struct {
+		fixture string
+		dev     string
+	}{
+		// Not in the topology at all
+		{"mirror.xml", "/dev/ada9p4"},
+		// Whole disk, with nothing to put boot code in
+		{"mirror.xml", "/dev/ada0"},
+		// A path of the multipath device, not the device itself
+		{"multipath.xml", "/dev/da0"},
+		// gmirror device over two disks, not partitioned
+		{"gmirror.xml", "/dev/mirror/gm0"},
+	}
+	for _, test := range tests {
+		topo := loadfixture(t, test.fixture)
+		if d, err := topo.DiskOf(test.dev); err == nil {
+			t.Errorf("%s %s: got disk %s, want an error",
+				test.fixture, test.dev, d.Name)
+		}
+	}
+}
+
+func TestDisksOf(t *testing.T) {
+	tests := []struct {
+		fixture string
+		devs    []string
+		disks   []string
+	}{
+		{
+			"mirror.xml",
+			[]string{"/dev/gpt/zfs0", "/dev/gpt/zfs1"},
+			[]string{"ada0", "ada1"},
+		},
+		{
+			// Two devices on one disk only give the disk once, and the
+			// whole disk device is skipped
+			"mirror.xml",
+			[]string{"/dev/ada0p4", "/dev/ada0p3", "/dev/ada1"},
+			[]string{"ada0"},
+		},
+		{
+			"geli.xml",
+			[]string{"/dev/ada0p4.eli", "/dev/gpt/zfs1.eli"},
+			[]string{"ada0", "ada1"},
+		},
+		{
+			"multipath.xml",
+			[]string{"/dev/multipath/disk1p4"},
+			[]string{"multipath/disk1"},
+		},
+	}
+	for _, test := range tests {
+		topo := loadfixture(t, test.fixture)
+		list, err := topo.disksof("zroot", test.devs)
+		if err != nil {
+			t.Errorf("%s %v: %v", test.fixture, test.devs, err)
+			continue
+		}
+		var names []string
+		for _, d := range list {
+			names = append(names, d.Name)
+		}
+		if !reflect.DeepEqual(names, test.disks) {
+			t.Errorf("%s %v: disks = %v, want %v",
+				test.fixture, test.devs, names, test.disks)
+		}
+	}
+
+	topo := loadfixture(t, "mirror.xml")
+	if _, err := topo.disksof("zroot", []string{"/dev/ada0"}); err == nil {
+		t.Error("got disks for a pool on whole disks")
+	}
+}
@@ -0,0 +1,108 @@
+package disks
+
+import (
+	"bufio"
+	"errors"
+	"github.com/trueos/sysup/logger"
+	"os/exec"
+	"strings"
+)
+
+// Pool sections which don't hold data the boot loader reads
+var skipsections = map[string]bool{
+	"logs":   true,
+	"cache":  true,
+	"spares": true,
+}
+
+// Get the leaf devices of a pool from "zpool status -P" output, leaving out
+// log, cache and spare devices
+func parsezpoolstatus(status string) []string {
+	var devs []string
+	inconfig := false
+	toplevel := -1
+	section := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(status))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if !inconfig {
+			if len(fields) > 0 && fields[0] == "NAME" {
+				inconfig = true
+			}
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		// The config ends with the next "errors:" or similar heading
+		if !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " ") {
+			break
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, "\t "))
+		if toplevel < 0 {
+			toplevel = indent
+		}
+		if indent == toplevel {
+			section = fields[0]
+			continue
+		}
+		if skipsections[section] {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "/dev/") {
+			devs = append(devs, fields[0])
+		}
+	}
+	return devs
+}
+
+// Get the leaf devices of a pool
+func PoolDevices(pool string) ([]string, error) {
+	out, err := exec.Command("zpool", "status", "-P", pool).CombinedOutput()
+	if err != nil {
+		return nil, errors.New(
+			"Failed zpool status " + pool + ": " +
+				strings.TrimSpace(string(out)),
+		)
+	}
+	devs := parsezpoolstatus(string(out))
+	if len(devs) == 0 {
+		return nil, errors.New("No devices found in pool: " + pool)
+	}
+	return devs, nil
+}
+
+// Get the partitioned disks a pool lives on, skipping any whole-disk devices
+// which can't hold boot code
+func (t *Topology) PoolDisks(pool string) ([]Disk, error) {
+	devs, err := PoolDevices(pool)
+	if err != nil {
+		return nil, err
+	}
+	return t.disksof(pool, devs)
+}
+
+// Get the partitioned disks a list of pool devices live on
+func (t *Topology) disksof(pool string, devs []string) ([]Disk, error) {
+	var list []Disk
+	seen := make(map[string]bool)
+	for _, dev := range devs {
+		d, err := t.DiskOf(dev)
+		if err != nil {
+			logger.LogToFile("Skipping pool device: " + err.Error())
+			continue
+		}
+		if seen[d.Name] {
+			continue
+		}
+		seen[d.Name] = true
+		list = append(list, d)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("No partitioned disks found in pool: " + pool)
+	}
+	return list, nil
+}
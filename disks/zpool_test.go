@@ -0,0 +1,105 @@
+package disks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseZpoolStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		devs   []string
+	}{
+		{
+			"mirror with logs, cache and spares",
+			`  pool: zroot
+ state: ONLINE
+  scan: scrub repaired 0B in 00:01:12 with 0 errors on Sun Oct 18 03:01:12 2026
+config:
+
+	NAME                 STATE     READ WRITE CKSUM
+	zroot                ONLINE       0     0     0
+	  mirror-0           ONLINE       0     0     0
+	    /dev/gpt/zfs0    ONLINE       0     0     0
+	    /dev/gpt/zfs1    ONLINE       0     0     0
+	logs
+	  /dev/gpt/log0      ONLINE       0     0     0
+	cache
+	  /dev/gpt/cache0    ONLINE       0     0     0
+	spares
+	  /dev/gpt/spare0    AVAIL
+
+errors: No known data errors
+`,
+			[]string{"/dev/gpt/zfs0", "/dev/gpt/zfs1"},
+		},
+		{
+			"single disk",
+			`  pool: zroot
+ state: ONLINE
+config:
+
+	NAME          STATE     READ WRITE CKSUM
+	zroot         ONLINE       0     0     0
+	  /dev/ada0p4 ONLINE       0     0     0
+
+errors: No known data errors
+`,
+			[]string{"/dev/ada0p4"},
+		},
+		{
+			"raidz with a disk being replaced",
+			`  pool: zroot
+ state: DEGRADED
+status: One or more devices is currently being resilvered.
+config:
+
+	NAME                   STATE     READ WRITE CKSUM
+	zroot                  DEGRADED     0     0     0
+	  raidz1-0             DEGRADED     0     0     0
+	    /dev/ada0p4.eli    ONLINE       0     0     0
+	    replacing-1        DEGRADED     0     0     0
+	      /dev/ada1p4.eli  UNAVAIL      0     0     0  cannot open
+	      /dev/ada3p4.eli  ONLINE       0     0     0  (resilvering)
+	    /dev/ada2p4.eli    ONLINE       0     0     0
+	logs
+	  mirror-1             ONLINE       0     0     0
+	    /dev/gpt/log0      ONLINE       0     0     0
+	    /dev/gpt/log1      ONLINE       0     0     0
+
+errors: No known data errors
+`,
+			[]string{
+				"/dev/ada0p4.eli", "/dev/ada1p4.eli", "/dev/ada3p4.eli",
+				"/dev/ada2p4.eli",
+			},
+		},
+		{
+			"nothing read after errors:",
+			`  pool: zroot
+config:
+
+	NAME             STATE     READ WRITE CKSUM
+	zroot            ONLINE       0     0     0
+	  /dev/gpt/zfs0  ONLINE       0     0     0
+errors: Permanent errors have been detected in the following files:
+
+	  /dev/gpt/zfs9
+`,
+			[]string{"/dev/gpt/zfs0"},
+		},
+		{
+			"no config",
+			"cannot open 'zroot': no such pool\n",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		if got := parsezpoolstatus(test.status); !reflect.DeepEqual(
+			got, test.devs,
+		) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.devs)
+		}
+	}
+}
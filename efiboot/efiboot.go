@@ -0,0 +1,140 @@
+package efiboot
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Firmware boot entry
+type Entry struct {
+	Num    string `json:"num"`
+	Label  string `json:"label"`
+	Active bool   `json:"active"`
+	// Partition and loader the entry boots, if efibootmgr could map them
+	Device string `json:"device,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// GPT UUID of the partition from the device path, which unlike Device
+	// doesn't depend on how the partition is named
+	PartUUID string `json:"partuuid,omitempty"`
+}
+
+// Manages the firmware boot entries
+type Manager interface {
+	List() ([]Entry, error)
+	// Create an active entry for path on the EFI partition dev, which is
+	// mounted on mnt
+	Create(dev string, mnt string, path string, label string) error
+	Activate(num string) error
+	Deactivate(num string) error
+	SetBootNext(num string) error
+}
+
+// Manager which changes the real boot entries with efibootmgr
+type EFIBootMgr struct{}
+
+// Used for every change to the boot entries, replaceable so tests can fake it
+var DefaultManager Manager = EFIBootMgr{}
+
+// Start of the device path after the label
+var devpathre = regexp.MustCompile(`\s[A-Za-z]+\(`)
+
+// GPT partition and file in the device path
+var hdre = regexp.MustCompile(`HD\(\d+,GPT,([0-9A-Fa-f-]+),`)
+var filere = regexp.MustCompile(`(?:^|[\s/])File\(([^)]*)\)`)
+
+// Parse the output of "efibootmgr -v"
+func parselist(out string) []Entry {
+	var entries []Entry
+	for _, line := range strings.Split(out, "\n") {
+		trimmed := strings.TrimLeft(line, " +")
+		if strings.HasPrefix(trimmed, "Boot") && len(trimmed) >= 9 &&
+			(trimmed[8] == '*' || trimmed[8] == ' ') &&
+			isnum(trimmed[4:8]) {
+			e := Entry{Num: trimmed[4:8], Active: trimmed[8] == '*'}
+			rest := strings.TrimSpace(trimmed[9:])
+			devpath := ""
+			if loc := devpathre.FindStringIndex(rest); loc != nil {
+				rest, devpath = rest[:loc[0]], rest[loc[0]:]
+			}
+			e.Label = strings.TrimSpace(rest)
+			if m := hdre.FindStringSubmatch(devpath); m != nil {
+				e.PartUUID = strings.ToLower(m[1])
+			}
+			// Used unless efibootmgr maps it to a partition below
+			if m := filere.FindStringSubmatch(devpath); m != nil {
+				e.Path = strings.Replace(m[1], "\\", "/", -1)
+			}
+			entries = append(entries, e)
+			continue
+		}
+
+		// Indented line mapping the last entry to a partition and file
+		fields := strings.Fields(line)
+		if len(entries) == 0 || len(fields) == 0 || line[0] != ' ' {
+			continue
+		}
+		last := &entries[len(entries)-1]
+		if last.Device != "" {
+			continue
+		}
+		if i := strings.Index(fields[0], ":/"); i > 0 {
+			last.Device = fields[0][:i]
+			last.Path = fields[0][i+1:]
+		}
+	}
+	return entries
+}
+
+// Check for a 4 digit hex boot number
+func isnum(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789ABCDEFabcdef", c) {
+			return false
+		}
+	}
+	return len(s) == 4
+}
+
+func run(args ...string) (string, error) {
+	out, err := exec.Command("efibootmgr", args...).CombinedOutput()
+	if err != nil {
+		return "", errors.New(
+			"Failed efibootmgr " + strings.Join(args, " ") + ": " +
+				strings.TrimSpace(string(out)),
+		)
+	}
+	return string(out), nil
+}
+
+func (EFIBootMgr) List() ([]Entry, error) {
+	out, err := run("-v")
+	if err != nil {
+		return nil, err
+	}
+	return parselist(out), nil
+}
+
+func (EFIBootMgr) Create(
+	dev string, mnt string, path string, label string,
+) error {
+	_, err := run("-c", "-a", "-L", label, "-l", filepath.Join(mnt, path))
+	return err
+}
+
+func (EFIBootMgr) Activate(num string) error {
+	_, err := run("-a", "-b", num)
+	return err
+}
+
+func (EFIBootMgr) Deactivate(num string) error {
+	_, err := run("-A", "-b", num)
+	return err
+}
+
+func (EFIBootMgr) SetBootNext(num string) error {
+	_, err := run("-n", "-b", num)
+	return err
+}
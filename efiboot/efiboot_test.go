@@ -0,0 +1,117 @@
+package efiboot
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Output of "efibootmgr -v" on a system dual booting Windows, with the
+// FreeBSD partition mapped to its diskid name
+const listoutput = `Boot to FW : false
+BootCurrent: 0004
+Timeout    : 2 seconds
+BootOrder  : 0004, 0003, 0000, 0001, 0002
++Boot0004* FreeBSD (ada0p1) HD(1,GPT,F859C46D-19EE-4E40-8975-3AD1AB00AC09,0x28,0x64000)/File(\EFI\FREEBSD\LOADER.EFI)
+                           diskid/DISK-S3Z1NB0K100001Ap1:/EFI/FREEBSD/LOADER.EFI /boot/efi//EFI/FREEBSD/LOADER.EFI
+ Boot0003* Windows Boot Manager HD(2,GPT,0b5b8e56-3e2d-4b1c-9a4f-52e0a1f4e9ab,0x1000,0x32000)/File(\EFI\Microsoft\Boot\bootmgfw.efi)
+                           ada1p2:/EFI/Microsoft/Boot/bootmgfw.efi (null)
+ Boot0000* EFI Network 0 for IPv4 (00-0C-29-5A-11-7E) PciRoot(0x0)/Pci(0x11,0x0)/Pci(0x1,0x0)/MAC(000c295a117e,1)/IPv4(0.0.0.0,0,DHCP,0.0.0.0,0.0.0.0,0.0.0.0)
+ Boot0001* EFI Internal Shell FvVol(7cb8bdc9-f8eb-4f34-aaea-3ee4af6516a1)/FvFile(7c04a583-9e3e-4f1c-ad65-e05268d0b4d1)
+ Boot0002  TrueOS HD(1,GPT,f859c46d-19ee-4e40-8975-3ad1ab00ac09,0x28,0x64000)/File(\EFI\BOOT\BOOTX64-TRUEOS.EFI)
+
+
+Unreferenced Variables:
+`
+
+func TestParseList(t *testing.T) {
+	want := []Entry{
+		{
+			Num:      "0004",
+			Label:    "FreeBSD (ada0p1)",
+			Active:   true,
+			Device:   "diskid/DISK-S3Z1NB0K100001Ap1",
+			Path:     "/EFI/FREEBSD/LOADER.EFI",
+			PartUUID: "f859c46d-19ee-4e40-8975-3ad1ab00ac09",
+		},
+		{
+			Num:      "0003",
+			Label:    "Windows Boot Manager",
+			Active:   true,
+			Device:   "ada1p2",
+			Path:     "/EFI/Microsoft/Boot/bootmgfw.efi",
+			PartUUID: "0b5b8e56-3e2d-4b1c-9a4f-52e0a1f4e9ab",
+		},
+		{
+			Num:    "0000",
+			Label:  "EFI Network 0 for IPv4 (00-0C-29-5A-11-7E)",
+			Active: true,
+		},
+		{
+			Num:    "0001",
+			Label:  "EFI Internal Shell",
+			Active: true,
+		},
+		{
+			// Not mapped to a partition, the path comes from the device path
+			Num:      "0002",
+			Label:    "TrueOS",
+			Path:     "/EFI/BOOT/BOOTX64-TRUEOS.EFI",
+			PartUUID: "f859c46d-19ee-4e40-8975-3ad1ab00ac09",
+		},
+	}
+
+	got := parselist(listoutput)
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("entry %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseListEmpty(t *testing.T) {
+	if got := parselist("BootOrder  : \n"); len(got) != 0 {
+		t.Fatalf("got entries from an empty list: %+v", got)
+	}
+}
+
+func TestFake(t *testing.T) {
+	f := NewFake([]Entry{{Num: "0001", Label: "Windows", Active: true}})
+	f.UUIDs = map[string]string{"ada0p1": "f859c46d"}
+	f.Devices = map[string]string{"ada0p1": "gpt/efiboot0"}
+
+	if err := f.Create("ada0p1", "/boot/efi", "efi/freebsd/loader.efi",
+		"FreeBSD"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := f.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Entry{
+		Num:      "0002",
+		Label:    "FreeBSD",
+		Active:   true,
+		Device:   "gpt/efiboot0",
+		Path:     "/efi/freebsd/loader.efi",
+		PartUUID: "f859c46d",
+	}
+	if len(entries) != 2 || !reflect.DeepEqual(entries[1], want) {
+		t.Fatalf("entries = %+v, want %+v added", entries, want)
+	}
+
+	if err := f.Deactivate("0002"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetBootNext("0002"); err != nil {
+		t.Fatal(err)
+	}
+	if f.Entries[1].Active || f.BootNext != "0002" {
+		t.Fatalf("entry %+v, BootNext %q", f.Entries[1], f.BootNext)
+	}
+	if err := f.Activate("0009"); err == nil {
+		t.Fatal("activated an entry which doesn't exist")
+	}
+}
@@ -0,0 +1,100 @@
+package efiboot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Manager which only changes a list of entries in memory, for tests and
+// for working out what a change would do
+type Fake struct {
+	Entries  []Entry
+	BootNext string
+	// If set every call fails with it
+	Err error
+	// GPT UUIDs of partitions by device name, given to created entries
+	UUIDs map[string]string
+	// Name the firmware maps a partition back to, when it isn't the one
+	// the entry was created with
+	Devices map[string]string
+}
+
+// Create a fake manager starting from a copy of some entries
+func NewFake(entries []Entry) *Fake {
+	return &Fake{Entries: append([]Entry(nil), entries...)}
+}
+
+func (f *Fake) find(num string) (*Entry, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	for i := range f.Entries {
+		if f.Entries[i].Num == num {
+			return &f.Entries[i], nil
+		}
+	}
+	return nil, errors.New("No such boot entry: Boot" + num)
+}
+
+func (f *Fake) List() ([]Entry, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return append([]Entry(nil), f.Entries...), nil
+}
+
+func (f *Fake) Create(
+	dev string, mnt string, path string, label string,
+) error {
+	if f.Err != nil {
+		return f.Err
+	}
+	var highest int64 = -1
+	for _, e := range f.Entries {
+		if n, err := strconv.ParseInt(e.Num, 16, 32); err == nil &&
+			n > highest {
+			highest = n
+		}
+	}
+	e := Entry{
+		Num:      fmt.Sprintf("%04X", highest+1),
+		Label:    label,
+		Active:   true,
+		Device:   dev,
+		Path:     "/" + strings.TrimPrefix(path, "/"),
+		PartUUID: f.UUIDs[dev],
+	}
+	if name, ok := f.Devices[dev]; ok {
+		e.Device = name
+	}
+	f.Entries = append(f.Entries, e)
+	return nil
+}
+
+func (f *Fake) Activate(num string) error {
+	e, err := f.find(num)
+	if err != nil {
+		return err
+	}
+	e.Active = true
+	return nil
+}
+
+func (f *Fake) Deactivate(num string) error {
+	e, err := f.find(num)
+	if err != nil {
+		return err
+	}
+	e.Active = false
+	return nil
+}
+
+func (f *Fake) SetBootNext(num string) error {
+	if _, err := f.find(num); err != nil {
+		return err
+	}
+	f.BootNext = num
+	return nil
+}
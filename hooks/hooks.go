@@ -0,0 +1,105 @@
+package hooks
+
+import (
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/ws"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The update phases we run hooks for
+const (
+	PreCheck   = "pre-check"
+	PreStage1  = "pre-stage1"
+	PostStage1 = "post-stage1"
+	PreStage2  = "pre-stage2"
+	PostStage2 = "post-stage2"
+	PostBoot   = "post-boot"
+	PreLive    = "pre-live"
+	PostLive   = "post-live"
+)
+
+// Build the environment describing an update for the hook scripts
+func StageEnv(info defines.StageInfo) []string {
+	yesno := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+
+	env := []string{
+		"SYSUP_BENAME=" + info.BEName,
+		"SYSUP_OLDBENAME=" + info.OldBEName,
+		"SYSUP_KERNELUPDATE=" + yesno(info.KernelUp),
+		"SYSUP_FULLUPDATE=" + yesno(info.FullUpdate),
+		"SYSUP_ONLY=" + info.Only,
+	}
+	if info.Details != nil {
+		d := info.Details
+		env = append(
+			env,
+			"SYSUP_PKG_NEW="+strconv.Itoa(len(d.New)),
+			"SYSUP_PKG_UPGRADE="+strconv.Itoa(len(d.Up)),
+			"SYSUP_PKG_DOWNGRADE="+strconv.Itoa(len(d.Down)),
+			"SYSUP_PKG_REINSTALL="+strconv.Itoa(len(d.Ri)),
+			"SYSUP_PKG_DELETE="+strconv.Itoa(len(d.Del)),
+		)
+	}
+	if info.Loader != nil {
+		env = append(env, "SYSUP_LOADER_STATUS="+info.Loader.Status)
+	}
+	return env
+}
+
+// Get the executable hook scripts for a phase, in the order to run them
+func scripts(phase string) []string {
+	dir := filepath.Join(defines.HooksDir, phase)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	// ReadDir returns these sorted by name already
+	var found []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+			continue
+		}
+		if !e.Mode().IsRegular() || e.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		found = append(found, filepath.Join(dir, name))
+	}
+	return found
+}
+
+// Run the hook scripts for a phase, stopping at the first that fails
+func Run(phase string, env []string) error {
+	for _, script := range scripts(phase) {
+		logger.LogToFile("Running " + phase + " hook: " + script)
+		ws.SendMsg("Running " + phase + " hook: " + filepath.Base(script))
+
+		cmd := exec.Command(script, phase)
+		cmd.Env = append(os.Environ(), "SYSUP_PHASE="+phase)
+		cmd.Env = append(cmd.Env, env...)
+		out, err := cmd.CombinedOutput()
+		if len(out) > 0 {
+			logger.LogToFile(string(out))
+		}
+		if err != nil {
+			return errors.New(
+				phase + " hook " + filepath.Base(script) + " failed: " +
+					err.Error(),
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// Package testlog keeps tests from writing to the system sysup log
+package testlog
+
+import (
+	"github.com/trueos/sysup/defines"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Run the tests of a package with the log kept in a temp directory,
+// meant to be called from TestMain
+func Run(m *testing.M) {
+	dir, err := ioutil.TempDir("", "sysup-test")
+	if err != nil {
+		panic(err)
+	}
+	defines.LogFile = filepath.Join(dir, "sysup.log")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -18,7 +18,9 @@ import (
 	"github.com/trueos/sysup/client"
 	"github.com/trueos/sysup/defines"
 	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/notify"
 	"github.com/trueos/sysup/pkg"
+	"github.com/trueos/sysup/scheduler"
 	"github.com/trueos/sysup/trains"
 	"github.com/trueos/sysup/update"
 	"github.com/trueos/sysup/utils"
@@ -96,12 +98,20 @@ func connectws(done chan bool) {
 // Parses the message and calls the responsible module
 func readws(w http.ResponseWriter, r *http.Request) {
 	var err error
-	defines.WSServer, err = defines.Updater.Upgrade(w, r, nil)
+	conn, err := defines.Updater.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("update:", err)
 		return
 	}
-	defer defines.WSServer.Close()
+	defines.WSServer = conn
+	defer conn.Close()
+
+	// Don't let the scheduler try talking to a closed connection
+	defer func() {
+		if defines.WSServer == conn {
+			defines.WSServer = nil
+		}
+	}()
 	for {
 		_, message, err := defines.WSServer.ReadMessage()
 		if err != nil {
@@ -131,18 +141,43 @@ func readws(w http.ResponseWriter, r *http.Request) {
 			env.Method = "shutdown"
 		}
 
+		// Keep the scheduler from running at the same time
+		defines.OpLock.Lock()
+
+		// The scope of an update only lasts for the request which set it
+		defines.OnlyFlag = ""
+		defines.FullUpdateFlag = false
+
 		switch env.Method {
 		case "check":
-			pkg.CheckForUpdates()
+			trains.ReportTrain()
+			pkg.CheckForUpdates(message, update.GetPending())
 		case "listtrains":
-			trains.DoTrainList()
+			trains.DoTrainList(message)
 		case "settrain":
 			trains.DoSetTrain(message)
+		case "reverttrain":
+			trains.DoRevertTrain()
+		case "status":
+			update.DoStatus()
+		case "cancelstaged":
+			update.DoCancelStaged()
+		case "cancelreboot":
+			update.DoCancelReboot()
+		case "prunebes":
+			update.DoPruneBEs(message)
+		case "listbes":
+			update.DoListBEs()
+		case "beinfo":
+			update.DoBEInfo(message)
+		case "activatebe", "renamebe", "pinbe", "destroybe":
+			update.DoManageBE(message)
 		case "update":
 			update.DoUpdate(message)
 		case "updatebootloader":
-			update.UpdateLoader("")
-			ws.SendMsg("Finished bootloader process", "updatebootloader")
+			update.DoUpdateLoader()
+		case "bootloaderinfo":
+			update.DoLoaderInfo()
 		case "shutdown":
 			ws.SendMsg("Shutting down sysup", "shutdown")
 			os.Exit(0)
@@ -150,6 +185,8 @@ func readws(w http.ResponseWriter, r *http.Request) {
 			log.Println("Uknown JSON Method:", env.Method)
 		}
 
+		defines.OpLock.Unlock()
+
 		// log.Printf("server-recv: %s", message)
 		//err = defines.WSServers.WriteMessage(mt, message)
 		//if err != nil {
@@ -174,6 +211,7 @@ func checkuid() {
 }
 
 func main() {
+	flag.Parse()
 
 	if len(os.Args) == 1 {
 		flag.Usage()
@@ -199,6 +237,12 @@ func main() {
 
 	// Load the local config file if it exists
 	defines.LoadConfig()
+
+	// Finish up after booting into an updated system
+	if defines.PostBootFlag {
+		update.PostBoot()
+		os.Exit(0)
+	}
 	done := make(chan bool)
 	setupWs()
 
@@ -226,6 +270,72 @@ func main() {
 		os.Exit(0)
 	}
 
+	if defines.RevertTrainFlag {
+		connectws(done)
+		client.RevertTrain()
+		ws.CloseWs()
+		<-done
+		os.Exit(0)
+	}
+
+	if defines.StatusFlag {
+		connectws(done)
+		client.Status()
+		ws.CloseWs()
+		<-done
+		os.Exit(0)
+	}
+
+	if defines.CancelStagedFlag {
+		connectws(done)
+		client.CancelStaged()
+		ws.CloseWs()
+		<-done
+		os.Exit(0)
+	}
+
+	if defines.CancelRebootFlag {
+		connectws(done)
+		client.CancelReboot()
+		ws.CloseWs()
+		<-done
+		os.Exit(0)
+	}
+
+	if defines.ListBEsFlag {
+		connectws(done)
+		client.ListBEs()
+		ws.CloseWs()
+		<-done
+		os.Exit(0)
+	}
+
+	if defines.ActivateBEFlag != "" || defines.RenameBEFlag != "" ||
+		defines.PinBEFlag != "" || defines.UnpinBEFlag != "" ||
+		defines.DestroyBEFlag != "" {
+		connectws(done)
+		client.ManageBE()
+		ws.CloseWs()
+		<-done
+		os.Exit(0)
+	}
+
+	if defines.BEInfoFlag != "" {
+		connectws(done)
+		client.BEInfo()
+		ws.CloseWs()
+		<-done
+		os.Exit(0)
+	}
+
+	if defines.PruneBEsFlag {
+		connectws(done)
+		client.PruneBEs()
+		ws.CloseWs()
+		<-done
+		os.Exit(0)
+	}
+
 	if defines.CheckFlag {
 		connectws(done)
 		client.StartCheck()
@@ -244,6 +354,11 @@ func main() {
 
 	if defines.WebsocketFlag {
 		go startws(done)
+		// Deliver anything queued while we were rebooting
+		go notify.SendPending()
+		if defines.Schedule != nil {
+			go scheduler.New(*defines.Schedule, scheduler.SystemClock{}).Run(nil)
+		}
 		log.Println("Listening on", defines.WebsocketAddr)
 		logger.LogToFile("Listening on " + defines.WebsocketAddr)
 		<-done
@@ -0,0 +1,261 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/utils"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default seconds to wait on a webhook
+const defaulttimeout = 10
+
+// Keep the daemon and scheduler from sending the queue twice
+var pendinglock sync.Mutex
+
+// Guards the saved state of what each event was last sent about
+var statelock sync.Mutex
+
+// Details of an event sent to webhooks and scripts
+type Event struct {
+	Event   string              `json:"event"`
+	Host    string              `json:"host"`
+	Time    time.Time           `json:"time"`
+	Message string              `json:"message,omitempty"`
+	BEName  string              `json:"bename,omitempty"`
+	Details *defines.UpdateInfo `json:"details,omitempty"`
+}
+
+// Create a new event for this host
+func NewEvent(event string, message string) Event {
+	host, _ := os.Hostname()
+	return Event{
+		Event:   event,
+		Host:    host,
+		Time:    time.Now(),
+		Message: message,
+	}
+}
+
+// Deliver an event to everything configured for it
+func Send(ev Event) error {
+	target, ok := defines.Notify[ev.Event]
+	if !ok {
+		return nil
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	var failed bool
+	for _, hook := range target.Webhooks {
+		if err := sendwebhook(hook, ev.Event, body); err != nil {
+			logger.LogToFile("Failed notifying " + hook.URL + ": " +
+				err.Error())
+			failed = true
+		}
+	}
+	for _, script := range target.Scripts {
+		if err := runscript(script, ev, body); err != nil {
+			logger.LogToFile("Failed notify script " + script + ": " +
+				err.Error())
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("Failed delivering " + ev.Event + " notification")
+	}
+	return nil
+}
+
+// Try to send an event now, queuing it to try again later if that fails
+func Deliver(ev Event) {
+	if err := Send(ev); err != nil {
+		Queue(ev)
+	}
+}
+
+// Send an event in the background, so slow or failing webhooks don't hold
+// up the caller. The event is queued first, if we exit before it is sent it
+// goes out with the next SendPending.
+func Post(ev Event) {
+	if _, ok := defines.Notify[ev.Event]; !ok {
+		return
+	}
+	if err := Queue(ev); err != nil {
+		go Send(ev)
+		return
+	}
+	go SendPending()
+}
+
+// Save an event to send later, for when the network isn't up yet such as
+// during stage 2
+func Queue(ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logger.LogToFile("Failed encoding notification: " + err.Error())
+		return err
+	}
+	if err := os.MkdirAll(defines.NotifySpool, 0700); err != nil {
+		logger.LogToFile("Failed queuing notification: " + err.Error())
+		return err
+	}
+	name := filepath.Join(
+		defines.NotifySpool,
+		strconv.FormatInt(ev.Time.UnixNano(), 10)+"-"+ev.Event+".json",
+	)
+	if err := utils.WriteFileAtomic(name, body, 0600); err != nil {
+		logger.LogToFile("Failed queuing notification: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+// Check if an event is about something other than when it was last sent,
+// going by a key describing what it is about. The key is saved for next
+// time, an empty key forgets what the event was last sent about.
+func Changed(event string, key string) bool {
+	statelock.Lock()
+	defer statelock.Unlock()
+
+	last := make(map[string]string)
+	if dat, err := ioutil.ReadFile(defines.NotifyState); err == nil {
+		if err := json.Unmarshal(dat, &last); err != nil {
+			logger.LogToFile("Ignoring invalid " + defines.NotifyState)
+		}
+	}
+	if last[event] == key {
+		return false
+	}
+
+	if key == "" {
+		delete(last, event)
+	} else {
+		last[event] = key
+	}
+	dat, err := json.Marshal(last)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(defines.NotifyState), 0755); err != nil {
+		logger.LogToFile("Failed saving notify state: " + err.Error())
+	} else if err := utils.WriteFileAtomic(
+		defines.NotifyState, dat, 0644,
+	); err != nil {
+		logger.LogToFile("Failed saving notify state: " + err.Error())
+	}
+	return true
+}
+
+// Send any queued events, oldest first. Events which fail to deliver are
+// left queued to try again later.
+func SendPending() {
+	pendinglock.Lock()
+	defer pendinglock.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(defines.NotifySpool, "*.json"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		dat, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal(dat, &ev); err != nil {
+			logger.LogToFile("Dropping invalid notification: " + file)
+			os.Remove(file)
+			continue
+		}
+		if err := Send(ev); err != nil {
+			continue
+		}
+		os.Remove(file)
+	}
+}
+
+// POST the event to a webhook, retrying with backoff on failure
+func sendwebhook(hook defines.Webhook, event string, body []byte) error {
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = defaulttimeout
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	var lasterr error
+	backoff := time.Second
+	for attempt := 0; attempt <= hook.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sysup-Event", event)
+		if hook.Secret != "" {
+			req.Header.Set("X-Sysup-Signature", "sha256="+sign(hook.Secret, body))
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lasterr = fmt.Errorf("%s returned %s", hook.URL, resp.Status)
+	}
+	return lasterr
+}
+
+// HMAC-SHA256 of the body as hex
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Run a local script with the event JSON on stdin
+func runscript(script string, ev Event, body []byte) error {
+	cmd := exec.Command(script, ev.Event)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(
+		os.Environ(),
+		"SYSUP_EVENT="+ev.Event,
+		"SYSUP_MESSAGE="+ev.Message,
+		"SYSUP_BENAME="+ev.BEName,
+	)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		logger.LogToFile(string(out))
+	}
+	return err
+}
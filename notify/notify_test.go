@@ -0,0 +1,225 @@
+package notify
+
+import (
+	"encoding/json"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/internal/testlog"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	testlog.Run(m)
+}
+
+// Point the spool and state at a fresh directory, returning a func
+// removing it
+func setup(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "sysup-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defines.NotifySpool = filepath.Join(dir, "spool")
+	defines.NotifyState = filepath.Join(dir, "notify.json")
+	defines.Notify = nil
+	return func() { os.RemoveAll(dir) }
+}
+
+// Webhook server recording what it received, failing the first fail
+// requests with a 500
+type hookserver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	fail     int
+	bodies   [][]byte
+	headers  []http.Header
+	received chan bool
+}
+
+func newhookserver(fail int) *hookserver {
+	h := &hookserver{fail: fail, received: make(chan bool, 10)}
+	h.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if h.fail > 0 {
+				h.fail--
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			h.bodies = append(h.bodies, body)
+			h.headers = append(h.headers, r.Header)
+			h.received <- true
+		},
+	))
+	return h
+}
+
+func (h *hookserver) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.bodies)
+}
+
+func spooled(t *testing.T) []string {
+	files, err := filepath.Glob(filepath.Join(defines.NotifySpool, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSendSigned(t *testing.T) {
+	defer setup(t)()
+	h := newhookserver(0)
+	defer h.Close()
+	defines.Notify = map[string]defines.NotifyTarget{
+		"staged": {Webhooks: []defines.Webhook{
+			{URL: h.URL, Secret: "secret"},
+		}},
+	}
+
+	ev := NewEvent("staged", "Update staged")
+	ev.BEName = "13.0_2026-01-05"
+	if err := Send(ev); err != nil {
+		t.Fatal(err)
+	}
+	if h.count() != 1 {
+		t.Fatalf("webhook called %d times, want 1", h.count())
+	}
+
+	var got Event
+	if err := json.Unmarshal(h.bodies[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Event != "staged" || got.BEName != ev.BEName {
+		t.Fatalf("webhook got %+v", got)
+	}
+	if e := h.headers[0].Get("X-Sysup-Event"); e != "staged" {
+		t.Fatalf("X-Sysup-Event = %q", e)
+	}
+	want := "sha256=" + sign("secret", h.bodies[0])
+	if s := h.headers[0].Get("X-Sysup-Signature"); s != want {
+		t.Fatalf("X-Sysup-Signature = %q, want %q", s, want)
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	defer setup(t)()
+	h := newhookserver(1)
+	defer h.Close()
+	defines.Notify = map[string]defines.NotifyTarget{
+		"failed": {Webhooks: []defines.Webhook{{URL: h.URL, Retries: 1}}},
+	}
+
+	if err := Send(NewEvent("failed", "Update failed")); err != nil {
+		t.Fatal(err)
+	}
+	if h.count() != 1 {
+		t.Fatalf("webhook got %d events, want 1", h.count())
+	}
+}
+
+func TestSendFails(t *testing.T) {
+	defer setup(t)()
+	h := newhookserver(1)
+	defer h.Close()
+	defines.Notify = map[string]defines.NotifyTarget{
+		"failed": {Webhooks: []defines.Webhook{{URL: h.URL}}},
+	}
+
+	if err := Send(NewEvent("failed", "Update failed")); err == nil {
+		t.Fatal("Send succeeded on a failing webhook")
+	}
+}
+
+func TestPostInBackground(t *testing.T) {
+	defer setup(t)()
+	h := newhookserver(0)
+	defer h.Close()
+	defines.Notify = map[string]defines.NotifyTarget{
+		"updatefound": {Webhooks: []defines.Webhook{{URL: h.URL}}},
+	}
+
+	// Hold the queue so Post can only return if it doesn't wait on it
+	pendinglock.Lock()
+	Post(NewEvent("updatefound", "Updates are available"))
+	if n := len(spooled(t)); n != 1 {
+		pendinglock.Unlock()
+		t.Fatalf("%d events queued, want 1", n)
+	}
+	pendinglock.Unlock()
+
+	select {
+	case <-h.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event never delivered")
+	}
+
+	// Wait for the sent event to leave the queue
+	pendinglock.Lock()
+	n := len(spooled(t))
+	pendinglock.Unlock()
+	if n != 0 {
+		t.Fatalf("%d events still queued after sending", n)
+	}
+}
+
+func TestSendPendingKeepsFailed(t *testing.T) {
+	defer setup(t)()
+	h := newhookserver(1)
+	defer h.Close()
+	defines.Notify = map[string]defines.NotifyTarget{
+		"completed": {Webhooks: []defines.Webhook{{URL: h.URL}}},
+	}
+
+	if err := Queue(NewEvent("completed", "Update completed")); err != nil {
+		t.Fatal(err)
+	}
+	SendPending()
+	if n := len(spooled(t)); n != 1 {
+		t.Fatalf("%d events queued after a failure, want 1", n)
+	}
+
+	SendPending()
+	if n := len(spooled(t)); n != 0 {
+		t.Fatalf("%d events queued after sending, want 0", n)
+	}
+	if h.count() != 1 {
+		t.Fatalf("webhook got %d events, want 1", h.count())
+	}
+}
+
+func TestChanged(t *testing.T) {
+	defer setup(t)()
+
+	steps := []struct {
+		key  string
+		want bool
+	}{
+		{"a", true},
+		{"a", false},
+		{"b", true},
+		{"", true},
+		{"", false},
+		{"b", true},
+	}
+	for i, step := range steps {
+		if got := Changed("updatefound", step.key); got != step.want {
+			t.Fatalf("step %d: Changed(%q) = %v, want %v",
+				i, step.key, got, step.want)
+		}
+	}
+
+	// Other events are tracked on their own
+	if !Changed("staged", "b") {
+		t.Fatal("key for another event reported as unchanged")
+	}
+}
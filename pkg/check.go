@@ -1,27 +1,38 @@
 package pkg
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/hooks"
 	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/notify"
 	"github.com/trueos/sysup/ws"
 	"log"
+	"sort"
+	"strings"
 	"syscall"
 )
 
-func sendupdatedetails(haveupdates bool, updetails *defines.UpdateInfo) {
+func sendupdatedetails(
+	haveupdates bool, updetails *defines.UpdateInfo,
+	pending *defines.PendingReboot,
+) {
 	type JSONReply struct {
-		Method  string              `json:"method"`
-		Updates bool                `json:"updates"`
-		Details *defines.UpdateInfo `json:"details"`
+		Method  string                 `json:"method"`
+		Updates bool                   `json:"updates"`
+		Details *defines.UpdateInfo    `json:"details"`
+		Pending *defines.PendingReboot `json:"pending,omitempty"`
 	}
 
 	data := &JSONReply{
 		Method:  "check",
 		Updates: haveupdates,
 		Details: updetails,
+		Pending: pending,
 	}
 
 	msg, err := json.Marshal(data)
@@ -35,19 +46,85 @@ func sendupdatedetails(haveupdates bool, updetails *defines.UpdateInfo) {
 	}
 }
 
-func CheckForUpdates() {
-	PreparePkgConfig("")
-	UpdatePkgDb("")
-	updetails, haveupdates, uerr := UpdateDryRun(true)
+// Check for updates, also reporting any update already waiting on a reboot
+func CheckForUpdates(message []byte, pending *defines.PendingReboot) {
+	var s struct {
+		defines.Envelope
+		defines.SendReq
+	}
+	if err := json.Unmarshal(message, &s); err != nil {
+		log.Fatal(err)
+	}
+
+	// Limit the check to these packages
+	defines.OnlyFlag = s.Only
+	if err := CheckOnly(); err != nil {
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+
+	updetails, haveupdates, uerr := CheckUpdates()
 	if uerr != nil {
-		DestroyMdDev()
 		return
 	}
 
+	sendupdatedetails(haveupdates, updetails, pending)
+}
+
+// Check for updates and return the details instead of sending them
+func CheckUpdates() (*defines.UpdateInfo, bool, error) {
+	// Let the admin hooks veto the check
+	if err := hooks.Run(hooks.PreCheck, nil); err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return nil, false, err
+	}
+
+	PreparePkgConfig("")
+	UpdatePkgDb("")
+	updetails, haveupdates, uerr := UpdateDryRun(true)
+
 	// If we are using standalone update, cleanup
 	DestroyMdDev()
 
-	sendupdatedetails(haveupdates, updetails)
+	// Only notify about each set of updates once
+	if uerr == nil {
+		key := ""
+		if haveupdates {
+			key = updatekey(updetails)
+		}
+		if notify.Changed("updatefound", key) && haveupdates {
+			ev := notify.NewEvent("updatefound", "Updates are available")
+			ev.Details = updetails
+			notify.Post(ev)
+		}
+	}
+
+	return updetails, haveupdates, uerr
+}
+
+// Get a key which is the same for the same set of package changes
+func updatekey(details *defines.UpdateInfo) string {
+	var changes []string
+	for _, p := range details.New {
+		changes = append(changes, "new "+p.Name+"-"+p.Version)
+	}
+	for _, p := range details.Up {
+		changes = append(changes, "up "+p.Name+"-"+p.NewVersion)
+	}
+	for _, p := range details.Down {
+		changes = append(changes, "down "+p.Name+"-"+p.NewVersion)
+	}
+	for _, p := range details.Ri {
+		changes = append(changes, "ri "+p.Name)
+	}
+	for _, p := range details.Del {
+		changes = append(changes, "del "+p.Name+"-"+p.Version)
+	}
+	sort.Strings(changes)
+
+	sum := sha256.Sum256([]byte(strings.Join(changes, "\n")))
+	return hex.EncodeToString(sum[:])
 }
 
 func HaveOsVerChange() bool {
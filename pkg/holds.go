@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Message pkg gives when a plan needs to change a locked package
+const lockedmsg = "is locked and may not be modified"
+
+// Get the installed packages matching a pattern, as name -> version
+func matchinstalled(pattern string) map[string]string {
+	found := make(map[string]string)
+
+	// pkg exits non-zero if nothing matches
+	out, _ := exec.Command(
+		defines.PKGBIN, "-C", defines.PkgConf, "query", "-g", "%n %v",
+		pattern,
+	).Output()
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			found[fields[0]] = fields[1]
+		}
+	}
+	return found
+}
+
+// Get the version of a package the repo offers
+func remoteversion(name string) string {
+	out, err := exec.Command(
+		defines.PKGBIN, "-C", defines.PkgConf, "rquery", "-U", "%v", name,
+	).Output()
+	if err != nil {
+		return ""
+	}
+	lines := strings.Fields(string(out))
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[0]
+}
+
+func islocked(name string) bool {
+	out, err := exec.Command(
+		defines.PKGBIN, "-C", defines.PkgConf, "query", "%k", name,
+	).Output()
+	return err == nil && strings.TrimSpace(string(out)) == "1"
+}
+
+// Get the installed packages which are held, either outright or because the
+// repo version doesn't match their pin
+func getheld() []defines.HeldPkg {
+	held := make(map[string]defines.HeldPkg)
+	for _, pattern := range defines.Holds {
+		for name, version := range matchinstalled(pattern) {
+			held[name] = defines.HeldPkg{Name: name, Version: version}
+		}
+	}
+
+	for name, pin := range defines.Pins {
+		if _, ok := held[name]; ok {
+			continue
+		}
+		installed := matchinstalled(name)
+		version, ok := installed[name]
+		if !ok {
+			continue
+		}
+		// Let it update if the new version is one we allow
+		remote := remoteversion(name)
+		if match, _ := filepath.Match(pin, remote); remote == "" || match {
+			continue
+		}
+		held[name] = defines.HeldPkg{Name: name, Version: version, Pin: pin}
+	}
+
+	var names []string
+	for name := range held {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list []defines.HeldPkg
+	for _, name := range names {
+		list = append(list, held[name])
+	}
+	return list
+}
+
+// Lock the held packages in the package database so pkg plans around them,
+// returning the packages we locked which weren't already
+func lockheld(held []defines.HeldPkg) ([]string, error) {
+	var locked []string
+	for _, h := range held {
+		if islocked(h.Name) {
+			continue
+		}
+		logger.LogToFile("Locking held package: " + h.Name)
+		out, err := exec.Command(
+			defines.PKGBIN, "-C", defines.PkgConf, "lock", "-y", h.Name,
+		).CombinedOutput()
+		if err != nil {
+			return locked, errors.New(
+				"Failed locking held package " + h.Name + ": " +
+					strings.TrimSpace(string(out)),
+			)
+		}
+		locked = append(locked, h.Name)
+	}
+	return locked, nil
+}
+
+// Make sure the update plan leaves the held packages alone
+func checkheld(details *defines.UpdateInfo) error {
+	changed := make(map[string]bool)
+	for _, p := range details.Up {
+		changed[p.Name] = true
+	}
+	for _, p := range details.Down {
+		changed[p.Name] = true
+	}
+	for _, p := range details.Ri {
+		changed[p.Name] = true
+	}
+	for _, p := range details.Del {
+		changed[p.Name] = true
+	}
+
+	var broken []string
+	for _, h := range details.Held {
+		if changed[h.Name] {
+			broken = append(broken, h.Name)
+		}
+	}
+	if len(broken) > 0 {
+		return errors.New(
+			"Update would change held packages: " + strings.Join(broken, " "),
+		)
+	}
+	return nil
+}
+
+// Release the locks taken to honor holds once the update is installed
+func UnlockHeld(locked []string) {
+	for _, name := range locked {
+		out, err := exec.Command(
+			defines.PKGBIN, "-C", defines.PkgConf, "unlock", "-y", name,
+		).CombinedOutput()
+		if err != nil {
+			logger.LogToFile(
+				"Failed unlocking " + name + ": " + string(out),
+			)
+		}
+	}
+}
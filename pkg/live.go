@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"github.com/trueos/sysup/defines"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// Get the origin of a package, checking the installed packages first
+func pkgorigin(name string) string {
+	out, err := exec.Command(
+		defines.PKGBIN, "-C", defines.PkgConf, "query", "%o", name,
+	).Output()
+	if err != nil || len(strings.TrimSpace(string(out))) == 0 {
+		out, err = exec.Command(
+			defines.PKGBIN, "-C", defines.PkgConf, "rquery", "-U", "%o", name,
+		).Output()
+		if err != nil {
+			return ""
+		}
+	}
+	lines := strings.Fields(string(out))
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[0]
+}
+
+// Check if a package is part of the base system
+func isbasepkg(name string) bool {
+	if strings.HasPrefix(name, "FreeBSD-") {
+		return true
+	}
+	origin := pkgorigin(name)
+	return strings.HasPrefix(origin, "os/") || origin == "base"
+}
+
+// Get the base system packages changed by an update
+func BasePkgs(details *defines.UpdateInfo) []string {
+	var names []string
+	for _, p := range details.New {
+		names = append(names, p.Name)
+	}
+	for _, p := range details.Up {
+		names = append(names, p.Name)
+	}
+	for _, p := range details.Down {
+		names = append(names, p.Name)
+	}
+	for _, p := range details.Ri {
+		names = append(names, p.Name)
+	}
+	for _, p := range details.Del {
+		names = append(names, p.Name)
+	}
+
+	var base []string
+	for _, name := range names {
+		if isbasepkg(name) {
+			base = append(base, name)
+		}
+	}
+	return base
+}
+
+// Point the pkg config at the running system's database, for updating
+// without a new boot-environment
+func PrepareLivePkgConfig() {
+	var reposdir string
+	if defines.UpdateFileFlag != "" {
+		reposdir = MkReposFile("", defines.PkgDb)
+	} else if defines.ReposDir != "" {
+		reposdir = "REPOS_DIR: [ \"" + defines.ReposDir + "\", ]"
+	}
+
+	fdata := `PKG_CACHEDIR: ` + defines.CacheDir + `
+IGNORE_OSVERSION: YES
+` + reposdir + `
+` + defines.AbiOverride
+	ioutil.WriteFile(defines.PkgConf, []byte(fdata), 0644)
+}
+
+// Lock the held packages, returning the ones we locked
+func LockHeld(held []defines.HeldPkg) ([]string, error) {
+	return lockheld(held)
+}
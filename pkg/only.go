@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"regexp"
+	"strings"
+)
+
+// Characters allowed in package names and origins given to -only. These end
+// up in the rc intercept, so keep anything the shell cares about out.
+var onlyre = regexp.MustCompile(`^[A-Za-z0-9._+@/-]+$`)
+
+// Get the packages the update is limited to, if any
+func OnlyPkgs() []string {
+	var names []string
+	for _, name := range strings.Split(defines.OnlyFlag, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Validate the packages the update is limited to
+func CheckOnly() error {
+	if defines.OnlyFlag == "" {
+		return nil
+	}
+	names := OnlyPkgs()
+	if len(names) == 0 {
+		return errors.New("No packages given to -only")
+	}
+	for _, name := range names {
+		if !onlyre.MatchString(name) {
+			return errors.New("Invalid package name: " + name)
+		}
+	}
+	if defines.FullUpdateFlag {
+		return errors.New("-only can not be used with -fullupdate")
+	}
+
+	// Normalize so the rc intercept gets a clean list
+	defines.OnlyFlag = strings.Join(names, ",")
+	return nil
+}
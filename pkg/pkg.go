@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -182,6 +183,8 @@ func PreparePkgConfig(altabi string) {
 	if defines.UpdateFileFlag != "" {
 		mountofflineupdate()
 		reposdir = MkReposFile("", defines.PkgDb)
+	} else if defines.ReposDir != "" {
+		reposdir = "REPOS_DIR: [ \"" + defines.ReposDir + "\", ]"
 	}
 
 	// Check if we have an alternative ABI to specify
@@ -267,7 +270,19 @@ func UpdateDryRun(sendupdate bool) (*defines.UpdateInfo, bool, error) {
 	details := defines.UpdateInfo{}
 	updetails := &details
 
+	// Keep held packages out of the plan
+	held := getheld()
+	locked, err := lockheld(held)
+	if err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return updetails, false, err
+	}
+
+	var stderr bytes.Buffer
 	cmd := exec.Command(defines.PKGBIN, "-C", defines.PkgConf, "upgrade", "-n")
+	cmd.Args = append(cmd.Args, OnlyPkgs()...)
+	cmd.Stderr = &stderr
 	ws.SendMsg("Checking system for updates")
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -290,11 +305,31 @@ func UpdateDryRun(sendupdate bool) (*defines.UpdateInfo, bool, error) {
 	//if err := cmd.Wait(); err != nil {
 	//	log.Fatal(err)
 	//}
+	// The exit status doesn't help us, but we need stderr collected
+	cmd.Wait()
+
+	// pkg can't find a plan without changing a locked package
+	if strings.Contains(stderr.String(), lockedmsg) {
+		err := errors.New(
+			"Update would change held packages:\n" + stderr.String(),
+		)
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return updetails, false, err
+	}
 
 	haveupdates := !strings.Contains(strings.Join((allText), "\n"), "Your packages are up to date")
 	if haveupdates {
 		updetails = ParseUpdateData(allText)
 	}
+	updetails.Held = held
+	updetails.Locked = locked
+
+	if err := checkheld(updetails); err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return updetails, false, err
+	}
 
 	return updetails, haveupdates, nil
 }
@@ -307,6 +342,7 @@ func ParseUpdateData(uptext []string) *defines.UpdateInfo {
 	details := defines.UpdateInfo{}
 	detailsNew := defines.NewPkg{}
 	detailsUp := defines.UpPkg{}
+	detailsDown := defines.UpPkg{}
 	detailsRi := defines.RiPkg{}
 	detailsDel := defines.DelPkg{}
 
@@ -327,6 +363,10 @@ func ParseUpdateData(uptext []string) *defines.UpdateInfo {
 			stage = "UPGRADE"
 			continue
 		}
+		if strings.Contains(line, "DOWNGRADED:") {
+			stage = "DOWNGRADE"
+			continue
+		}
 		if strings.Contains(line, "REMOVED:") {
 			stage = "REMOVE"
 			continue
@@ -343,6 +383,10 @@ func ParseUpdateData(uptext []string) *defines.UpdateInfo {
 			stage = ""
 			continue
 		}
+		if strings.Contains(line, " to be downgraded:") {
+			stage = ""
+			continue
+		}
 		if strings.Contains(line, " to be REINSTALLED:") {
 			stage = ""
 			continue
@@ -373,6 +417,18 @@ func ParseUpdateData(uptext []string) *defines.UpdateInfo {
 				details.Up = append(details.Up, detailsUp)
 				continue
 			}
+		case "DOWNGRADE":
+			if strings.Contains(line, " -> ") {
+				linearray := strings.Split(line, " ")
+				if len(linearray) < 4 {
+					continue
+				}
+				detailsDown.Name = strings.Replace(linearray[0], ":", "", -1)
+				detailsDown.OldVersion = linearray[1]
+				detailsDown.NewVersion = linearray[3]
+				details.Down = append(details.Down, detailsDown)
+				continue
+			}
 		case "REINSTALLED":
 			if strings.Contains(line, " (") {
 				linearray := strings.Split(line, " (")
@@ -428,6 +484,9 @@ func ParseUpdateData(uptext []string) *defines.UpdateInfo {
 		details.KernelUp = true
 	}
 
+	// Base system and kernel changes need a new boot-environment
+	details.Reboot = details.KernelUp || len(BasePkgs(&details)) > 0
+
 	//	log.Print("UpdateInfo", details)
 	return &details
 }
@@ -467,3 +526,13 @@ func GetKernelPkgName() string {
 	logger.LogToFile("Kernel package: " + kernel)
 	return kernel
 }
+
+// Check if a package is installed
+func PkgInstalled(name string) bool {
+	return len(matchinstalled(name)) > 0
+}
+
+// Check if a package is installed or available from the repo
+func PkgExists(name string) bool {
+	return PkgInstalled(name) || remoteversion(name) != ""
+}
@@ -0,0 +1,264 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/notify"
+	"github.com/trueos/sysup/pkg"
+	"github.com/trueos/sysup/trains"
+	"github.com/trueos/sysup/update"
+	"github.com/trueos/sysup/utils"
+	"github.com/trueos/sysup/ws"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Source of time for the scheduler, so tests can control it
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Clock backed by the system time
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// What we remember between runs of the daemon
+type State struct {
+	LastCheck time.Time `json:"lastcheck"`
+	LastFetch time.Time `json:"lastfetch"`
+	LastStage time.Time `json:"laststage"`
+	NextCheck time.Time `json:"nextcheck"`
+	// Updates were found that are waiting for the maintenance window
+	PendingStage bool `json:"pendingstage"`
+}
+
+// Event broadcast to clients after each scheduled action
+type Event struct {
+	Method  string              `json:"method"`
+	Event   string              `json:"event"`
+	Time    time.Time           `json:"time"`
+	Updates bool                `json:"updates"`
+	Details *defines.UpdateInfo `json:"details,omitempty"`
+}
+
+type Scheduler struct {
+	clock     Clock
+	interval  time.Duration
+	jitter    time.Duration
+	window    defines.MaintWindow
+	autofetch bool
+	autostage bool
+	rand      *rand.Rand
+	statefile string
+	state     State
+
+	// The actions we schedule, replaceable for testing
+	check func() (*defines.UpdateInfo, bool, error)
+	fetch func()
+	stage func()
+}
+
+func New(conf defines.ScheduleConfig, clock Clock) *Scheduler {
+	interval, _ := time.ParseDuration(conf.Interval)
+	jitter, _ := time.ParseDuration(conf.Jitter)
+
+	s := &Scheduler{
+		clock:     clock,
+		interval:  interval,
+		jitter:    jitter,
+		window:    conf.Window,
+		autofetch: conf.AutoFetch,
+		autostage: conf.AutoStage,
+		rand:      rand.New(rand.NewSource(clock.Now().UnixNano())),
+		statefile: defines.ScheduleState,
+		check:     runcheck,
+		fetch:     func() { runupdate(true) },
+		stage:     func() { runupdate(false) },
+	}
+	s.loadstate()
+	return s
+}
+
+// Run the schedule until stop is closed
+func (s *Scheduler) Run(stop <-chan bool) {
+	logger.LogToFile("Scheduler started, checking every " + s.interval.String())
+	for {
+		now := s.clock.Now()
+		next := s.nextrun(now)
+		logger.LogToFile("Next scheduled run: " + next.Format(time.RFC1123))
+
+		var wait time.Duration
+		if next.After(now) {
+			wait = next.Sub(now)
+		}
+		select {
+		case <-s.clock.After(wait):
+		case <-stop:
+			return
+		}
+
+		s.RunOnce(s.clock.Now())
+	}
+}
+
+// Get when we next need to wake up
+func (s *Scheduler) nextrun(now time.Time) time.Time {
+	if s.state.NextCheck.IsZero() {
+		s.state.NextCheck = now.Add(s.randjitter())
+		s.savestate()
+	}
+	next := s.state.NextCheck
+
+	// Waiting on the maintenance window to stage updates
+	if s.state.PendingStage {
+		open := s.nextwindow(now)
+		if open.Before(next) {
+			next = open
+		}
+	}
+	return next
+}
+
+// Do whatever is due at the given time
+func (s *Scheduler) RunOnce(now time.Time) {
+	defer s.savestate()
+
+	if !now.Before(s.state.NextCheck) {
+		s.state.LastCheck = now
+		s.state.NextCheck = now.Add(s.interval + s.randjitter())
+
+		details, haveupdates, err := s.check()
+		if err != nil {
+			logger.LogToFile("Scheduled check failed: " + err.Error())
+			return
+		}
+		s.broadcast("check", now, haveupdates, details)
+		if !haveupdates {
+			s.state.PendingStage = false
+			return
+		}
+
+		s.state.PendingStage = s.autostage
+
+		// Staging fetches for us, so only fetch if that isn't happening now
+		if s.autofetch && !(s.autostage && s.InWindow(now)) {
+			s.state.LastFetch = now
+			s.fetch()
+			s.broadcast("fetch", now, haveupdates, details)
+		}
+	}
+
+	if s.state.PendingStage && s.InWindow(now) {
+		s.state.PendingStage = false
+		s.state.LastStage = now
+		s.stage()
+		s.broadcast("stage", now, true, nil)
+	}
+}
+
+// Check if we are inside the maintenance window
+func (s *Scheduler) InWindow(t time.Time) bool {
+	return s.window.Contains(t)
+}
+
+// Get the next time the maintenance window opens, plus jitter
+func (s *Scheduler) nextwindow(now time.Time) time.Time {
+	next := s.window.Next(now)
+	if next.IsZero() {
+		// Shouldn't happen with a validated config, try again next check
+		return s.state.NextCheck
+	}
+	return next.Add(s.randjitter())
+}
+
+func (s *Scheduler) randjitter() time.Duration {
+	if s.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(s.rand.Int63n(int64(s.jitter)))
+}
+
+func (s *Scheduler) broadcast(
+	event string, now time.Time, updates bool, details *defines.UpdateInfo,
+) {
+	// Don't write over the top of a client request in progress
+	defines.OpLock.Lock()
+	defer defines.OpLock.Unlock()
+
+	ws.Broadcast(&Event{
+		Method:  "scheduler",
+		Event:   event,
+		Time:    now,
+		Updates: updates,
+		Details: details,
+	})
+}
+
+func (s *Scheduler) loadstate() {
+	dat, err := ioutil.ReadFile(s.statefile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(dat, &s.state); err != nil {
+		logger.LogToFile("Ignoring invalid schedule state: " + s.statefile)
+		s.state = State{}
+	}
+}
+
+func (s *Scheduler) savestate() {
+	dat, err := json.Marshal(s.state)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.statefile), 0755); err != nil {
+		logger.LogToFile("Failed saving schedule state: " + err.Error())
+		return
+	}
+	if err := utils.WriteFileAtomic(s.statefile, dat, 0644); err != nil {
+		logger.LogToFile("Failed saving schedule state: " + err.Error())
+	}
+}
+
+func runcheck() (*defines.UpdateInfo, bool, error) {
+	defines.OpLock.Lock()
+	defer defines.OpLock.Unlock()
+
+	// Retry anything that couldn't be delivered before, without holding
+	// up the check on slow webhooks
+	go notify.SendPending()
+
+	// Scheduled checks always cover every package
+	defines.OnlyFlag = ""
+	defines.FullUpdateFlag = false
+
+	// The train is only changed when updating
+	trains.ReportTrain()
+	return pkg.CheckUpdates()
+}
+
+func runupdate(fetchonly bool) {
+	defines.OpLock.Lock()
+	defer defines.OpLock.Unlock()
+
+	msg, err := json.Marshal(&defines.SendReq{
+		Method:    "update",
+		Fetchonly: fetchonly,
+	})
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	update.DoUpdate(msg)
+}
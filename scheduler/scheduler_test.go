@@ -0,0 +1,219 @@
+package scheduler
+
+import (
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/internal/testlog"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clock which only moves when the scheduler waits on it
+type fakeclock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeclock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeclock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// Counts of the scheduled actions which ran
+type actions struct {
+	checks, fetches, stages int
+	updates                 bool
+}
+
+var start = time.Date(2026, time.January, 5, 12, 0, 0, 0, time.UTC)
+
+func TestMain(m *testing.M) {
+	testlog.Run(m)
+}
+
+// Scheduler running the fake actions a, with its state in a fresh directory,
+// returned along with a func removing it
+func newscheduler(
+	t *testing.T, clock Clock, window defines.MaintWindow, a *actions,
+) (*Scheduler, func()) {
+	dir, err := ioutil.TempDir("", "sysup-scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scheduler{
+		clock:     clock,
+		interval:  time.Hour,
+		window:    window,
+		autofetch: true,
+		autostage: true,
+		rand:      rand.New(rand.NewSource(1)),
+		statefile: filepath.Join(dir, "schedule.json"),
+		check: func() (*defines.UpdateInfo, bool, error) {
+			a.checks++
+			return nil, a.updates, nil
+		},
+		fetch: func() { a.fetches++ },
+		stage: func() { a.stages++ },
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+// Window from 02:00 to 04:00, which start is outside of
+var nightly = defines.MaintWindow{Start: 2, End: 4}
+
+func TestRunOnceChecksWhenDue(t *testing.T) {
+	a := &actions{}
+	s, cleanup := newscheduler(t, &fakeclock{now: start}, nightly, a)
+	defer cleanup()
+
+	s.RunOnce(start)
+	if a.checks != 1 {
+		t.Fatalf("checks = %d, want 1", a.checks)
+	}
+	if want := start.Add(time.Hour); !s.state.NextCheck.Equal(want) {
+		t.Fatalf("next check = %v, want %v", s.state.NextCheck, want)
+	}
+
+	s.RunOnce(start.Add(30 * time.Minute))
+	if a.checks != 1 {
+		t.Fatalf("checked again before the interval passed")
+	}
+
+	s.RunOnce(start.Add(time.Hour))
+	if a.checks != 2 {
+		t.Fatalf("checks = %d, want 2", a.checks)
+	}
+}
+
+func TestRunOnceFetchesAndWaitsForWindow(t *testing.T) {
+	a := &actions{updates: true}
+	s, cleanup := newscheduler(t, &fakeclock{now: start}, nightly, a)
+	defer cleanup()
+
+	s.RunOnce(start)
+	if a.fetches != 1 || a.stages != 0 {
+		t.Fatalf("fetches = %d, stages = %d, want 1, 0", a.fetches, a.stages)
+	}
+	if !s.state.PendingStage {
+		t.Fatal("staging should wait for the window")
+	}
+
+	// The window opens at 02:00 the next day, before any check is due
+	s.state.NextCheck = start.Add(48 * time.Hour)
+	open := time.Date(2026, time.January, 6, 2, 0, 0, 0, time.UTC)
+	if next := s.nextrun(start); !next.Equal(open) {
+		t.Fatalf("next run = %v, want %v", next, open)
+	}
+
+	s.RunOnce(open)
+	if a.stages != 1 || a.checks != 1 {
+		t.Fatalf("stages = %d, checks = %d, want 1, 1", a.stages, a.checks)
+	}
+	if s.state.PendingStage {
+		t.Fatal("pending stage not cleared after staging")
+	}
+}
+
+func TestRunOnceStagesInWindow(t *testing.T) {
+	a := &actions{updates: true}
+	s, cleanup := newscheduler(t, &fakeclock{now: start}, defines.MaintWindow{}, a)
+	defer cleanup()
+
+	s.RunOnce(start)
+	if a.stages != 1 {
+		t.Fatalf("stages = %d, want 1", a.stages)
+	}
+	// Staging fetches by itself
+	if a.fetches != 0 {
+		t.Fatalf("fetches = %d, want 0", a.fetches)
+	}
+}
+
+func TestRunOnceNoUpdatesClearsPending(t *testing.T) {
+	a := &actions{}
+	s, cleanup := newscheduler(t, &fakeclock{now: start}, nightly, a)
+	defer cleanup()
+	s.state.PendingStage = true
+
+	s.RunOnce(start)
+	if s.state.PendingStage {
+		t.Fatal("pending stage kept with no updates")
+	}
+	if a.fetches != 0 || a.stages != 0 {
+		t.Fatalf("fetches = %d, stages = %d, want 0, 0", a.fetches, a.stages)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	s, cleanup := newscheduler(t, &fakeclock{now: start}, nightly, &actions{})
+	defer cleanup()
+	if j := s.randjitter(); j != 0 {
+		t.Fatalf("jitter = %v without any configured", j)
+	}
+
+	s.jitter = 10 * time.Minute
+	for i := 0; i < 100; i++ {
+		if j := s.randjitter(); j < 0 || j >= s.jitter {
+			t.Fatalf("jitter %v out of range", j)
+		}
+	}
+}
+
+func TestStateSaved(t *testing.T) {
+	a := &actions{updates: true}
+	s, cleanup := newscheduler(t, &fakeclock{now: start}, nightly, a)
+	defer cleanup()
+	s.RunOnce(start)
+
+	loaded := &Scheduler{statefile: s.statefile}
+	loaded.loadstate()
+	if !loaded.state.NextCheck.Equal(s.state.NextCheck) ||
+		!loaded.state.LastCheck.Equal(start) ||
+		!loaded.state.PendingStage {
+		t.Fatalf("loaded state %+v, want %+v", loaded.state, s.state)
+	}
+}
+
+func TestRunWaitsForInterval(t *testing.T) {
+	clock := &fakeclock{now: start}
+	a := &actions{}
+	s, cleanup := newscheduler(t, clock, nightly, a)
+	defer cleanup()
+
+	stop := make(chan bool)
+	check := s.check
+	s.check = func() (*defines.UpdateInfo, bool, error) {
+		if a.checks == 2 {
+			close(stop)
+		}
+		return check()
+	}
+	s.Run(stop)
+
+	if a.checks < 3 {
+		t.Fatalf("checks = %d, want at least 3", a.checks)
+	}
+	want := []time.Duration{0, time.Hour, time.Hour}
+	for i, d := range want {
+		if clock.waits[i] != d {
+			t.Fatalf("wait %d = %v, want %v", i, clock.waits[i], d)
+		}
+	}
+}
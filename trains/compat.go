@@ -0,0 +1,107 @@
+package trains
+
+import (
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/utils"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Details of this host that trains may place requirements on
+type hostinfo struct {
+	version string
+	abi     string
+	arch    string
+	flavor  string
+}
+
+// Base flavors we know how to detect from the installed userland package
+var baseflavors = []string{"generic", "nozfs", "zol"}
+
+func gethostinfo() hostinfo {
+	h := hostinfo{version: defines.Version}
+
+	// Fall back to the installed package if we weren't built with a version
+	if h.version == "" {
+		out, err := exec.Command(
+			defines.PKGBIN, "query", "%v", defines.ToolName,
+		).Output()
+		if err == nil {
+			h.version = strings.TrimSpace(string(out))
+		}
+	}
+
+	out, err := exec.Command(defines.PKGBIN, "config", "ABI").Output()
+	if err == nil {
+		h.abi = strings.TrimSpace(string(out))
+	} else {
+		logger.LogToFile("Failed getting host ABI")
+	}
+
+	arch, err := syscall.Sysctl("hw.machine_arch")
+	if err == nil {
+		h.arch = arch
+	} else {
+		logger.LogToFile("Failed getting hw.machine_arch")
+	}
+
+	for _, f := range baseflavors {
+		cmd := exec.Command(defines.PKGBIN, "query", "%n", "os-"+f+"-userland")
+		if err := cmd.Run(); err == nil {
+			h.flavor = f
+			break
+		}
+	}
+
+	return h
+}
+
+// Check a train against the host, returning why it can't be used or an empty
+// string if it is compatible. Checks against host details we couldn't
+// determine are skipped.
+func checkcompat(train defines.TrainDef, h hostinfo) string {
+	if train.MinSysUpVersion != "" && h.version != "" &&
+		utils.CompareVersions(h.version, train.MinSysUpVersion) < 0 {
+		return "requires " + defines.ToolName + " " +
+			train.MinSysUpVersion + " or newer (have " + h.version + ")"
+	}
+
+	if len(train.ABIs) > 0 && h.abi != "" && !matchany(train.ABIs, h.abi) {
+		return "ABI " + h.abi + " not supported (supports " +
+			strings.Join(train.ABIs, ", ") + ")"
+	}
+
+	if len(train.Arches) > 0 && h.arch != "" &&
+		!matchany(train.Arches, h.arch) {
+		return "architecture " + h.arch + " not supported (supports " +
+			strings.Join(train.Arches, ", ") + ")"
+	}
+
+	if train.Flavor != "" && h.flavor != "" && train.Flavor != h.flavor {
+		return "requires the " + train.Flavor + " flavor (have " +
+			h.flavor + ")"
+	}
+
+	return ""
+}
+
+// Check if value matches any of the glob patterns
+func matchany(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if match, _ := filepath.Match(pattern, value); match {
+			return true
+		}
+	}
+	return false
+}
+
+// Flag every train this host can't use
+func markcompat(trainlist *defines.TrainsDef) {
+	h := gethostinfo()
+	for i := range trainlist.Trains {
+		trainlist.Trains[i].Incompatible = checkcompat(trainlist.Trains[i], h)
+	}
+}
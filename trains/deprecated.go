@@ -0,0 +1,147 @@
+package trains
+
+import (
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/ws"
+)
+
+// Look up a train by name
+func findtrain(trainlist defines.TrainsDef, name string) (defines.TrainDef, bool) {
+	for i := range trainlist.Trains {
+		if trainlist.Trains[i].Name == name {
+			return trainlist.Trains[i], true
+		}
+	}
+	return defines.TrainDef{}, false
+}
+
+// Follow the NewTrain chain from a deprecated train to the first train which
+// is still active
+func followtrain(
+	trainlist defines.TrainsDef, train defines.TrainDef,
+) (defines.TrainDef, error) {
+	visited := map[string]bool{train.Name: true}
+	for train.Deprecated {
+		if train.NewTrain == "" {
+			return train, errors.New(
+				"Train " + train.Name + " is deprecated with no replacement",
+			)
+		}
+		if visited[train.NewTrain] {
+			return train, errors.New(
+				"Train migration loop detected at " + train.NewTrain,
+			)
+		}
+		next, ok := findtrain(trainlist, train.NewTrain)
+		if !ok {
+			return train, errors.New(
+				"Replacement train " + train.NewTrain + " does not exist",
+			)
+		}
+		visited[next.Name] = true
+		train = next
+	}
+	return train, nil
+}
+
+// Let clients know the train we are on is deprecated
+func senddeprecated(train defines.TrainDef) {
+	ws.Broadcast(&struct {
+		Method string `json:"method"`
+		defines.TrainDeprecated
+	}{
+		Method: "traindeprecated",
+		TrainDeprecated: defines.TrainDeprecated{
+			Train:    train.Name,
+			NewTrain: train.NewTrain,
+			Follow:   defines.FollowTrains,
+		},
+	})
+}
+
+// Check if the current train has been deprecated, and if the config allows
+// it, switch to its replacement. Only done before updating.
+//
+// An error is only returned if we tried and failed to change trains
+func CheckTrain() error {
+	return checktrain(true)
+}
+
+// Report if the current train has been deprecated, without changing the
+// train. Used by checks, which leave the system as it is.
+func ReportTrain() {
+	checktrain(false)
+}
+
+func checktrain(change bool) error {
+	// Offline updates don't use trains
+	if defines.UpdateFileFlag != "" || len(trainsources()) == 0 {
+		return nil
+	}
+	current, err := getdefaulttrain()
+	if err != nil || current == "" {
+		return nil
+	}
+
+	trainlist, err := gettrains(true)
+	if err != nil {
+		logger.LogToFile("Unable to check current train: " + err.Error())
+		return nil
+	}
+	train, ok := findtrain(trainlist, current)
+	if !ok || !train.Deprecated {
+		return nil
+	}
+
+	logger.LogToFile(
+		"Train " + train.Name + " is deprecated, replaced by: " +
+			train.NewTrain,
+	)
+	senddeprecated(train)
+	if !defines.FollowTrains {
+		return nil
+	}
+	if !change {
+		ws.SendMsg("Train " + train.Name +
+			" is deprecated and will be changed on the next update")
+		return nil
+	}
+
+	if trainlist.Stale {
+		ws.SendMsg("Unable to reach trains server, not changing trains")
+		return nil
+	}
+	newtrain, err := followtrain(trainlist, train)
+	if err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg("Not changing trains: " + err.Error())
+		return nil
+	}
+	if newtrain.PkgURL == "" {
+		ws.SendMsg("Not changing trains: " + newtrain.Name +
+			" is missing PkgURL")
+		return nil
+	}
+	if reason := checkpolicy(newtrain); reason != "" {
+		ws.SendMsg("Not changing trains: " + newtrain.Name +
+			" is not allowed: " + reason)
+		return nil
+	}
+	if newtrain.Incompatible != "" {
+		ws.SendMsg("Not changing trains: " + newtrain.Name +
+			" is not compatible with this system: " + newtrain.Incompatible)
+		return nil
+	}
+
+	ws.SendMsg("Changing train: " + train.Name + " -> " + newtrain.Name)
+	if err := createnewpkgconf(newtrain); err != nil {
+		logger.LogToFile("Failed changing train: " + err.Error())
+		ws.SendMsg("Failed changing train: "+err.Error(), "fatal")
+		return err
+	}
+	logger.LogToFile("Train changed: " + train.Name + " -> " + newtrain.Name)
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package trains
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Details about the cached copy of a trains manifest
+type cachemeta struct {
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"lastmodified"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// A verified trains manifest and where it came from
+type manifest struct {
+	data  []byte
+	sig   []byte
+	meta  cachemeta
+	stale bool
+}
+
+func trainshttpclient() *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(defines.TrainsTimeout) * time.Second,
+	}
+}
+
+// Fetch a trains manifest, using the local cache when the remote copy has
+// not changed, or when the remote server can't be reached
+func fetchmanifest(
+	trainsurl string, pubkey string, cachedir string,
+) (manifest, error) {
+	cached, cerr := readcache(cachedir)
+
+	m, unreachable, err := fetchremote(trainsurl, cached, cerr == nil)
+	if err != nil {
+		if !unreachable || cerr != nil {
+			return m, err
+		}
+
+		// Offline, fall back to the last copy we verified
+		logger.LogToFile("Using cached trains manifest: " + err.Error())
+		cached.stale = true
+		if verr := verifymanifest(cached, pubkey); verr != nil {
+			return cached, verr
+		}
+		return cached, nil
+	}
+
+	if err := verifymanifest(m, pubkey); err != nil {
+		return m, err
+	}
+
+	// Only ever cache data which has passed verification
+	m.meta.Fetched = time.Now()
+	if err := writecache(cachedir, m); err != nil {
+		logger.LogToFile("Failed caching trains manifest: " + err.Error())
+	}
+
+	return m, nil
+}
+
+// Fetch the manifest and signature from remote. The bool returned is true if
+// the failure was caused by the server being unreachable.
+func fetchremote(
+	trainsurl string, cached manifest, havecache bool,
+) (manifest, bool, error) {
+	m := manifest{}
+	client := trainshttpclient()
+
+	req, err := http.NewRequest("GET", trainsurl, nil)
+	if err != nil {
+		return m, false, errors.New("Invalid trains URL " + trainsurl)
+	}
+	if havecache {
+		if cached.meta.ETag != "" {
+			req.Header.Set("If-None-Match", cached.meta.ETag)
+		}
+		if cached.meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.meta.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		_, neterr := err.(*url.Error)
+		return m, neterr, errors.New("Failed fetching " + trainsurl)
+	}
+
+	// Cleanup when we exit
+	defer resp.Body.Close()
+
+	// Our cached copy is still current
+	if resp.StatusCode == http.StatusNotModified && havecache {
+		return cached, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return m, false, fmt.Errorf(
+			"Failed fetching %s: %s", trainsurl, resp.Status,
+		)
+	}
+
+	// Load the file into memory
+	m.data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return m, false, errors.New("Failed reading train file!")
+	}
+	m.meta.ETag = resp.Header.Get("ETag")
+	m.meta.LastModified = resp.Header.Get("Last-Modified")
+
+	// Now fetch the sig
+	sresp, err := client.Get(trainsurl + ".sha1")
+	if err != nil {
+		_, neterr := err.(*url.Error)
+		return m, neterr, errors.New("Failed fetching " + trainsurl + ".sha1")
+	}
+
+	// Cleanup when we exit
+	defer sresp.Body.Close()
+
+	if sresp.StatusCode != http.StatusOK {
+		return m, false, fmt.Errorf(
+			"Failed fetching %s.sha1: %s", trainsurl, sresp.Status,
+		)
+	}
+
+	// Load the file into memory
+	m.sig, err = ioutil.ReadAll(sresp.Body)
+	if err != nil {
+		return m, false, errors.New("Failed reading train signature file!")
+	}
+
+	return m, false, nil
+}
+
+// Verify the manifest against its signature with the given pubkey
+func verifymanifest(m manifest, pubkey string) error {
+	// Load the PEM key
+	trainpub, terr := loadtrainspub(pubkey)
+	if terr != nil {
+		return errors.New("Failed to load train pubkey!")
+	}
+	block, _ := pem.Decode(trainpub)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return errors.New("failed to decode PEM block containing public key")
+	}
+
+	// Get the public key from PEM
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.New("Failed to parse pub key")
+	}
+	rsapub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("Train pubkey is not an RSA key")
+	}
+
+	hashed := sha512.Sum512(m.data)
+
+	// Now verify the signatures match
+	err = rsa.VerifyPKCS1v15(rsapub, crypto.SHA512, hashed[:], m.sig)
+	if err != nil {
+		return errors.New("Failed trains verification!")
+	}
+
+	return nil
+}
+
+func readcache(cachedir string) (manifest, error) {
+	m := manifest{}
+
+	dat, err := ioutil.ReadFile(filepath.Join(cachedir, "trains.json"))
+	if err != nil {
+		return m, err
+	}
+	sdat, err := ioutil.ReadFile(filepath.Join(cachedir, "trains.json.sha1"))
+	if err != nil {
+		return m, err
+	}
+	mdat, err := ioutil.ReadFile(filepath.Join(cachedir, "trains.meta"))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(mdat, &m.meta); err != nil {
+		return m, err
+	}
+
+	m.data = dat
+	m.sig = sdat
+	return m, nil
+}
+
+func writecache(cachedir string, m manifest) error {
+	if err := os.MkdirAll(cachedir, 0755); err != nil {
+		return err
+	}
+
+	mdat, err := json.Marshal(m.meta)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"trains.json", m.data},
+		{"trains.json.sha1", m.sig},
+		{"trains.meta", mdat},
+	}
+	for _, f := range files {
+		if err := utils.WriteFileAtomic(
+			filepath.Join(cachedir, f.name), f.data, 0644,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
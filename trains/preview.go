@@ -0,0 +1,80 @@
+package trains
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/pkg"
+	"github.com/trueos/sysup/ws"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Run the update planner against a train without changing the system repo
+// configuration, and send back what changing to it would do
+func previewtrain(train defines.TrainDef) {
+	pdir := filepath.Join(defines.SysUpDb, "trainpreview")
+	reposdir := filepath.Join(pdir, "repos")
+	keyfile := filepath.Join(pdir, "train-pkg.key")
+
+	os.RemoveAll(pdir)
+	if err := os.MkdirAll(reposdir, 0755); err != nil {
+		ws.SendMsg("Failed making directory: "+reposdir, "fatal")
+		return
+	}
+	defer os.RemoveAll(pdir)
+
+	// Same config createnewpkgconf would write, using our own key file
+	conf := strings.Replace(
+		trainpkgconf(train), defines.TrainPkgKey, keyfile, -1,
+	)
+	if err := ioutil.WriteFile(
+		keyfile, []byte(strings.Join(train.PkgKey, "\n")), 0644,
+	); err != nil {
+		ws.SendMsg("Failed writing "+keyfile, "fatal")
+		return
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(reposdir, "Train.conf"), []byte(conf), 0644,
+	); err != nil {
+		ws.SendMsg("Failed writing preview train config", "fatal")
+		return
+	}
+
+	ws.SendMsg("Checking package changes for train: " + train.Name)
+	defines.ReposDir = reposdir
+	defer func() { defines.ReposDir = "" }()
+
+	pkg.PreparePkgConfig("")
+	pkg.UpdatePkgDb("")
+	details, haveupdates, err := pkg.UpdateDryRun(true)
+	if err != nil {
+		return
+	}
+
+	type JSONReply struct {
+		Method  string              `json:"method"`
+		Train   string              `json:"train"`
+		Updates bool                `json:"updates"`
+		Details *defines.UpdateInfo `json:"details"`
+	}
+
+	data := &JSONReply{
+		Method:  "trainpreview",
+		Train:   train.Name,
+		Updates: haveupdates,
+		Details: details,
+	}
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
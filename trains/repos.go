@@ -0,0 +1,265 @@
+package trains
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/utils"
+	"github.com/trueos/sysup/ws"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Check if the admin asked us to leave this repo config alone
+func preservedrepo(name string) bool {
+	for _, pattern := range defines.PreserveRepos {
+		if match, _ := filepath.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the repo config files pkg will read
+func repoconfs() ([]string, error) {
+	return filepath.Glob(filepath.Join(defines.PkgConfDir, "*.conf"))
+}
+
+// Write each file into a temp file next to its target, returning a map of
+// target -> staged temp file
+func stagerepofiles(files map[string][]byte) (map[string]string, error) {
+	staged := make(map[string]string)
+	for tgt, data := range files {
+		if err := os.MkdirAll(filepath.Dir(tgt), 0755); err != nil {
+			cleanupstaged(staged)
+			return nil, err
+		}
+		tmp, err := ioutil.TempFile(
+			filepath.Dir(tgt), ".sysup-"+filepath.Base(tgt),
+		)
+		if err != nil {
+			cleanupstaged(staged)
+			return nil, err
+		}
+		staged[tgt] = tmp.Name()
+
+		_, err = tmp.Write(data)
+		if err == nil {
+			err = tmp.Sync()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), 0644)
+		}
+		if err != nil {
+			cleanupstaged(staged)
+			return nil, errors.New("Failed writing " + tgt + ": " + err.Error())
+		}
+	}
+	return staged, nil
+}
+
+// Remove any staged files which never made it into place
+func cleanupstaged(staged map[string]string) {
+	for _, tmp := range staged {
+		os.Remove(tmp)
+	}
+}
+
+// Move the staged files into place, starting with those listed in first
+func commitstaged(staged map[string]string, first ...string) error {
+	var order []string
+	order = append(order, first...)
+	var rest []string
+	for tgt := range staged {
+		rest = append(rest, tgt)
+	}
+	sort.Strings(rest)
+	order = append(order, rest...)
+
+	done := make(map[string]bool)
+	for _, tgt := range order {
+		tmp, ok := staged[tgt]
+		if !ok || done[tgt] {
+			continue
+		}
+		if err := os.Rename(tmp, tgt); err != nil {
+			return errors.New("Failed installing " + tgt + ": " + err.Error())
+		}
+		done[tgt] = true
+	}
+	return nil
+}
+
+// Remove the repo configs which aren't preserved or listed in keep
+func removerepos(keep map[string]bool) error {
+	confs, err := repoconfs()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, conf := range confs {
+		name := filepath.Base(conf)
+		if keep[name] || preservedrepo(name) {
+			continue
+		}
+		logger.LogToFile("Removing repo config: " + conf)
+		if err := os.Remove(conf); err != nil {
+			failed = append(failed, conf)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("Failed removing: " + strings.Join(failed, " "))
+	}
+	return nil
+}
+
+// Left in the train backup when there was no train key to save
+const nokeymarker = "no-train-key"
+
+// Save the current repo configs and train key so they can be restored
+func backuprepos() error {
+	tmpdir := defines.TrainBackupDir + ".new"
+	os.RemoveAll(tmpdir)
+	if err := os.MkdirAll(filepath.Join(tmpdir, "pkg"), 0755); err != nil {
+		return err
+	}
+
+	confs, err := repoconfs()
+	if err != nil {
+		return err
+	}
+	for _, conf := range confs {
+		if _, err := utils.Copyfile(
+			conf, filepath.Join(tmpdir, "pkg", filepath.Base(conf)),
+		); err != nil {
+			os.RemoveAll(tmpdir)
+			return err
+		}
+	}
+
+	if _, err := os.Stat(defines.TrainPkgKey); err == nil {
+		if _, err := utils.Copyfile(
+			defines.TrainPkgKey,
+			filepath.Join(tmpdir, filepath.Base(defines.TrainPkgKey)),
+		); err != nil {
+			os.RemoveAll(tmpdir)
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		// Remember there was no key, so a revert removes the one we add
+		if err := ioutil.WriteFile(
+			filepath.Join(tmpdir, nokeymarker), nil, 0644,
+		); err != nil {
+			os.RemoveAll(tmpdir)
+			return err
+		}
+	} else {
+		os.RemoveAll(tmpdir)
+		return err
+	}
+
+	// Only replace the previous backup once the new one is complete
+	if err := os.RemoveAll(defines.TrainBackupDir); err != nil {
+		return err
+	}
+	return os.Rename(tmpdir, defines.TrainBackupDir)
+}
+
+// Put back the repo configs saved by the last train change
+func restorerepos() error {
+	bdir := filepath.Join(defines.TrainBackupDir, "pkg")
+	if _, err := os.Stat(bdir); os.IsNotExist(err) {
+		return errors.New("No previous train configuration to restore")
+	}
+
+	confs, err := filepath.Glob(filepath.Join(bdir, "*.conf"))
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string][]byte)
+	keep := make(map[string]bool)
+	for _, conf := range confs {
+		data, err := ioutil.ReadFile(conf)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(conf)
+		files[filepath.Join(defines.PkgConfDir, name)] = data
+		keep[name] = true
+	}
+
+	var first []string
+	bkey := filepath.Join(
+		defines.TrainBackupDir, filepath.Base(defines.TrainPkgKey),
+	)
+	if data, err := ioutil.ReadFile(bkey); err == nil {
+		files[defines.TrainPkgKey] = data
+		first = append(first, defines.TrainPkgKey)
+	}
+
+	staged, err := stagerepofiles(files)
+	if err != nil {
+		return err
+	}
+	defer cleanupstaged(staged)
+
+	if err := commitstaged(staged, first...); err != nil {
+		return err
+	}
+
+	if err := removerepos(keep); err != nil {
+		return err
+	}
+
+	// The train change added a key where there wasn't one before
+	marker := filepath.Join(defines.TrainBackupDir, nokeymarker)
+	if _, err := os.Stat(marker); err == nil {
+		logger.LogToFile("Removing train key: " + defines.TrainPkgKey)
+		err := os.Remove(defines.TrainPkgKey)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore the repo configs from before the last train change
+func DoRevertTrain() {
+	if err := restorerepos(); err != nil {
+		logger.LogToFile("Failed reverting train: " + err.Error())
+		ws.SendMsg("Failed reverting train: "+err.Error(), "fatal")
+		return
+	}
+
+	// Send back confirmation
+	type JSONReply struct {
+		Method string `json:"method"`
+		Train  string `json:"train"`
+	}
+
+	deftrain, _ := getdefaulttrain()
+	data := &JSONReply{
+		Method: "reverttrain",
+		Train:  deftrain,
+	}
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,93 @@
+package trains
+
+import (
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/internal/testlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	testlog.Run(m)
+}
+
+// Point the repo configs, train key and backup at a fresh directory,
+// returning a func putting the old locations back
+func fakerepos(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "sysup-trains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	confdir, key, backup :=
+		defines.PkgConfDir, defines.TrainPkgKey, defines.TrainBackupDir
+	defines.PkgConfDir = filepath.Join(dir, "repos")
+	defines.TrainPkgKey = filepath.Join(dir, "keys", "train-pkg.key")
+	defines.TrainBackupDir = filepath.Join(dir, "train-backup")
+	if err := os.MkdirAll(defines.PkgConfDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		defines.PkgConfDir, defines.TrainPkgKey, defines.TrainBackupDir =
+			confdir, key, backup
+		os.RemoveAll(dir)
+	}
+}
+
+func writefile(t *testing.T, path string, data string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreReposRemovesAddedKey(t *testing.T) {
+	defer fakerepos(t)()
+	orig := filepath.Join(defines.PkgConfDir, "FreeBSD.conf")
+	writefile(t, orig, "FreeBSD: {}")
+
+	if err := backuprepos(); err != nil {
+		t.Fatal(err)
+	}
+
+	// What a train switch leaves behind
+	train := filepath.Join(defines.PkgConfDir, "train.conf")
+	writefile(t, train, "train: {}")
+	writefile(t, defines.TrainPkgKey, "new key")
+	os.Remove(orig)
+
+	if err := restorerepos(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(defines.TrainPkgKey); !os.IsNotExist(err) {
+		t.Fatal("train key added by the switch kept after reverting")
+	}
+	if _, err := os.Stat(train); !os.IsNotExist(err) {
+		t.Fatal("train repo config kept after reverting")
+	}
+	if data, err := ioutil.ReadFile(orig); err != nil ||
+		string(data) != "FreeBSD: {}" {
+		t.Fatalf("repo config not restored: %q %v", data, err)
+	}
+}
+
+func TestRestoreReposRestoresKey(t *testing.T) {
+	defer fakerepos(t)()
+	writefile(t, defines.TrainPkgKey, "old key")
+
+	if err := backuprepos(); err != nil {
+		t.Fatal(err)
+	}
+	writefile(t, defines.TrainPkgKey, "new key")
+
+	if err := restorerepos(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(defines.TrainPkgKey)
+	if err != nil || string(data) != "old key" {
+		t.Fatalf("train key = %q %v, want the old key", data, err)
+	}
+}
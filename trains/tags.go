@@ -0,0 +1,50 @@
+package trains
+
+import (
+	"github.com/trueos/sysup/defines"
+	"strings"
+)
+
+// Check if a train carries the given tag
+func hastag(train defines.TrainDef, tag string) bool {
+	for _, t := range train.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the trains which have every one of the given tags
+func filtertrains(trains []defines.TrainDef, tags []string) []defines.TrainDef {
+	var matched []defines.TrainDef
+	for _, train := range trains {
+		match := true
+		for _, tag := range tags {
+			tag = strings.TrimSpace(tag)
+			if tag != "" && !hastag(train, tag) {
+				match = false
+				break
+			}
+		}
+		if match {
+			matched = append(matched, train)
+		}
+	}
+	return matched
+}
+
+// Check a train against the configured tag policy, returning why it may not
+// be selected or an empty string if it is allowed
+func checkpolicy(train defines.TrainDef) string {
+	if len(defines.TrainTagPolicy) == 0 {
+		return ""
+	}
+	for _, tag := range defines.TrainTagPolicy {
+		if hastag(train, tag) {
+			return ""
+		}
+	}
+	return "policy requires one of the tags: " +
+		strings.Join(defines.TrainTagPolicy, ", ")
+}
@@ -2,108 +2,188 @@ package trains
 
 import (
 	"bufio"
-	"crypto"
-	"crypto/rsa"
-	"crypto/sha512"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
 	"github.com/trueos/sysup/ws"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
-// Load the trains from remote
-func loadtrains() (defines.TrainsDef, error) {
-
-	// Create our JSON struct
-	s := defines.TrainsDef{}
-
-	if defines.TrainsUrl == "" {
-		ws.SendMsg(
-			"No train URL defined in JSON configuration: "+
-				defines.ConfigJson,
-			"fatal",
-		)
-		return s, errors.New("ERROR")
+// Get the list of configured train sources, highest priority first
+func trainsources() []defines.TrainSource {
+	var sources []defines.TrainSource
+	if defines.TrainsUrl != "" {
+		sources = append(sources, defines.TrainSource{
+			Name:   "default",
+			URL:    defines.TrainsUrl,
+			PubKey: defines.TrainPubKey,
+		})
 	}
+	sources = append(sources, defines.TrainSources...)
+
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].Priority > sources[j].Priority
+	})
+	return sources
+}
 
-	//sendinfomsg("Fetching trains configuration")
-	resp, err := http.Get(defines.TrainsUrl)
+// Load the trains from remote, reporting any failure as fatal
+func loadtrains(allowstale bool) (defines.TrainsDef, error) {
+	s, err := gettrains(allowstale)
 	if err != nil {
-		ws.SendMsg("Failed fetching "+defines.TrainsUrl, "fatal")
+		ws.SendMsg(err.Error(), "fatal")
 		return s, errors.New("ERROR")
 	}
+	return s, nil
+}
 
-	// Cleanup when we exit
-	defer resp.Body.Close()
+// Files the trains manifest cache is made of
+var cachefiles = []string{"trains.json", "trains.json.sha1", "trains.meta"}
 
-	// Load the file into memory
-	dat, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		ws.SendMsg("Failed reading train file!", "fatal")
-		return s, errors.New("ERROR")
+// Move a trains cache left in the root of TrainsCache, from before there
+// were several train sources, to the directory of the default source
+func migratecache() {
+	old := filepath.Join(defines.TrainsCache, "trains.json")
+	if _, err := os.Stat(old); err != nil {
+		return
 	}
 
-	// Now fetch the sig
-	//sendinfomsg("Fetching trains signature")
-	sresp, serr := http.Get(defines.TrainsUrl + ".sha1")
-	if serr != nil {
-		ws.SendMsg("Failed fetching "+defines.TrainsUrl+".sha1", "fatal")
-		return s, errors.New("ERROR")
+	// Only keep it if the default source has no newer cache of its own
+	dest := filepath.Join(defines.TrainsCache, "default")
+	_, err := os.Stat(filepath.Join(dest, "trains.json"))
+	keep := os.IsNotExist(err) && defines.TrainsUrl != ""
+	if keep {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			logger.LogToFile("Failed creating " + dest + ": " + err.Error())
+			keep = false
+		}
 	}
+	for _, name := range cachefiles {
+		path := filepath.Join(defines.TrainsCache, name)
+		if keep {
+			if err := os.Rename(path, filepath.Join(dest, name)); err == nil {
+				continue
+			}
+		}
+		os.Remove(path)
+	}
+}
 
-	// Cleanup when we exit
-	defer sresp.Body.Close()
+// Load the trains from remote
+func gettrains(allowstale bool) (defines.TrainsDef, error) {
+	s, _, err := mergetrains(allowstale)
+	return s, err
+}
 
-	// Load the file into memory
-	sdat, err := ioutil.ReadAll(sresp.Body)
-	if err != nil {
-		ws.SendMsg("Failed reading train signature file!", "fatal")
-		return s, errors.New("ERROR")
-	}
+// Load the trains from remote
+//
+// Trains from every configured source are merged into one catalog, if two
+// sources have a train by the same name the higher priority source wins.
+//
+// If allowstale is set and a trains server can't be reached, the last
+// verified copy of its manifest is used and marked as stale.
+//
+// Also returned are the trains which an unreachable source might provide
+// instead, by train name, mapped to that source. A train in it must not be
+// picked since the higher priority definition could not be loaded.
+func mergetrains(
+	allowstale bool,
+) (defines.TrainsDef, map[string]string, error) {
 
-	// Load the PEM key
-	trainpub, terr := loadtrainspub()
-	if terr != nil {
-		ws.SendMsg("Failed to load train pubkey!", "fatal")
-		return s, errors.New("ERROR")
-	}
-	block, _ := pem.Decode(trainpub)
-	if block == nil || block.Type != "PUBLIC KEY" {
-		ws.SendMsg("failed to decode PEM block containing public key", "fatal")
-		return s, errors.New("ERROR")
-	}
+	// Create our JSON struct
+	s := defines.TrainsDef{}
+	shadowed := make(map[string]string)
 
-	// Get the public key from PEM
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
-		ws.SendMsg("Failed to parse pub key", "fatal")
-		return s, errors.New("ERROR")
+	sources := trainsources()
+	if len(sources) == 0 {
+		return s, shadowed, errors.New(
+			"No train URL defined in JSON configuration: " +
+				defines.ConfigJson,
+		)
 	}
+	migratecache()
+
+	var lasterr error
+	var loaded int
+	var oldest time.Time
+	// First unreachable source we know nothing about, it may have any train
+	var unknown string
+	seen := make(map[string]bool)
+	for _, src := range sources {
+		cachedir := filepath.Join(defines.TrainsCache, src.Name)
+		m, err := fetchmanifest(src.URL, src.PubKey, cachedir)
+		if err == nil && m.stale && !allowstale {
+			err = errors.New(
+				"Unable to reach " + src.URL +
+					", refusing to use cached train data",
+			)
+		}
+
+		// Lets decode this puppy
+		var strains defines.TrainsDef
+		if err == nil {
+			if jerr := json.Unmarshal(m.data, &strains); jerr != nil {
+				err = errors.New(
+					"Failed JSON parsing of train file from: " + src.URL,
+				)
+			}
+		}
+		if err != nil {
+			lasterr = err
+			logger.LogToFile("Train source " + src.Name + ": " + err.Error())
+			if len(sources) > 1 {
+				ws.SendMsg("Skipping train source " + src.Name + ": " +
+					err.Error())
+			}
 
-	hashed := sha512.Sum512(dat)
+			// Keep the names this source had last time, so a lower
+			// priority source can't stand in for them
+			names, cerr := cachedtrains(cachedir, src.PubKey)
+			if cerr != nil && unknown == "" {
+				unknown = src.Name
+			}
+			for _, name := range names {
+				if !seen[name] {
+					seen[name] = true
+					shadowed[name] = src.Name
+				}
+			}
+			continue
+		}
+		loaded++
 
-	// Now verify the signatures match
-	err = rsa.VerifyPKCS1v15(
-		pub.(*rsa.PublicKey), crypto.SHA512, hashed[:], sdat,
-	)
-	if err != nil {
-		ws.SendMsg("Failed trains verification!", "fatal")
-		return s, errors.New("ERROR")
-	}
+		// Report the oldest cached copy we had to fall back on
+		if m.stale {
+			if !s.Stale || m.meta.Fetched.Before(oldest) {
+				oldest = m.meta.Fetched
+				s.Fetched = oldest.Format(time.RFC1123)
+			}
+			s.Stale = true
+			s.StaleSources = append(s.StaleSources, src.Name)
+		}
 
-	// Lets decode this puppy
-	if err := json.Unmarshal(dat, &s); err != nil {
-		ws.SendMsg("Failed JSON parsing of train file!", "fatal")
-		return s, errors.New("ERROR")
+		for _, t := range strains.Trains {
+			if seen[t.Name] {
+				continue
+			}
+			seen[t.Name] = true
+			if unknown != "" {
+				shadowed[t.Name] = unknown
+			}
+			t.Source = src.Name
+			s.Trains = append(s.Trains, t)
+		}
+	}
+	if loaded == 0 {
+		return s, shadowed, lasterr
 	}
 
 	// Get the default train
@@ -112,15 +192,51 @@ func loadtrains() (defines.TrainsDef, error) {
 		s.Default = deftrain
 	}
 
-	return s, nil
+	// Flag any trains this host can't run
+	markcompat(&s)
+
+	return s, shadowed, nil
+}
+
+// Get the train names from the last verified copy of a source's manifest
+func cachedtrains(cachedir string, pubkey string) ([]string, error) {
+	cached, err := readcache(cachedir)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifymanifest(cached, pubkey); err != nil {
+		return nil, err
+	}
+	var strains defines.TrainsDef
+	if err := json.Unmarshal(cached.data, &strains); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, t := range strains.Trains {
+		names = append(names, t.Name)
+	}
+	return names, nil
 }
 
 // Get trains and reply
-func DoTrainList() {
-	trains, err := loadtrains()
+func DoTrainList(message []byte) {
+	var s struct {
+		defines.Envelope
+		defines.SendReq
+	}
+	if err := json.Unmarshal(message, &s); err != nil {
+		log.Fatal(err)
+	}
+
+	trains, err := loadtrains(true)
 	if err != nil {
 		return
 	}
+
+	// Only show the trains the client asked for
+	if s.Tag != "" {
+		trains.Trains = filtertrains(trains.Trains, strings.Split(s.Tag, ","))
+	}
 	sendtraindetails(trains)
 }
 
@@ -130,12 +246,16 @@ func sendtraindetails(trains defines.TrainsDef) {
 		Method  string             `json:"method"`
 		Trains  []defines.TrainDef `json:"trains"`
 		Default string             `json:"default"`
+		Stale   bool               `json:"stale"`
+		Fetched string             `json:"fetched"`
 	}
 
 	data := &JSONReply{
 		Method:  "listtrains",
 		Trains:  trains.Trains,
 		Default: trains.Default,
+		Stale:   trains.Stale,
+		Fetched: trains.Fetched,
 	}
 	msg, err := json.Marshal(data)
 	if err != nil {
@@ -150,7 +270,7 @@ func sendtraindetails(trains defines.TrainsDef) {
 
 func getdefaulttrain() (string, error) {
 	var deftrain string
-	fileHandle, err := os.Open("/etc/pkg/Train.conf")
+	fileHandle, err := os.Open(defines.TrainConf)
 	if err != nil {
 		return deftrain, err
 	}
@@ -172,52 +292,97 @@ func getdefaulttrain() (string, error) {
 	return deftrain, nil
 }
 
-// Load the default trains pub key we use to verify JSON validity
-func loadtrainspub() ([]byte, error) {
+// Get the name of the train we are on, if any
+func CurrentTrain() string {
+	current, _ := getdefaulttrain()
+	return current
+}
+
+// Get the extra essential packages listed by the current train
+func EssentialPkgs() []string {
+	// Offline updates don't use trains
+	if defines.UpdateFileFlag != "" || len(trainsources()) == 0 {
+		return nil
+	}
+	current, err := getdefaulttrain()
+	if err != nil || current == "" {
+		return nil
+	}
+
+	trainlist, err := gettrains(true)
+	if err != nil {
+		logger.LogToFile("Unable to load essential packages: " + err.Error())
+		return nil
+	}
+	train, ok := findtrain(trainlist, current)
+	if !ok {
+		return nil
+	}
+	return train.Essential
+}
+
+// Load the trains pub key we use to verify JSON validity
+func loadtrainspub(pubkey string) ([]byte, error) {
 	var dat []byte
 	// Try to load the default config file
-	if _, err := os.Stat(defines.TrainPubKey); os.IsNotExist(err) {
+	if _, err := os.Stat(pubkey); os.IsNotExist(err) {
 		return dat, err
 	}
 
 	// Load the file into memory
-	dat, err := ioutil.ReadFile(defines.TrainPubKey)
+	dat, err := ioutil.ReadFile(pubkey)
 	if err != nil {
-		log.Println("Failed reading train pubkey: " + defines.TrainPubKey)
+		log.Println("Failed reading train pubkey: " + pubkey)
 		return dat, err
 	}
 	return dat, nil
 }
 
-func createnewpkgconf(train defines.TrainDef) {
-	// Nuke existing pkg configs
-	cmd := exec.Command("/bin/sh", "-c", "rm -f /etc/pkg/*.conf")
-	cmd.Run()
-
-	// Write the new key file
-	var kdata []string
-	for i := range train.PkgKey {
-		kdata = append(kdata, train.PkgKey[i])
-	}
-	ioutil.WriteFile(
-		"/usr/share/keys/train-pkg.key", []byte(strings.Join(kdata, "\n")),
-		0644,
-	)
-
-	// Write the new conf file
-	fdata := `# TRAINNAME ` + train.Name + `
+// Generate the pkg repo config for a train
+func trainpkgconf(train defines.TrainDef) string {
+	return `# TRAINNAME ` + train.Name + `
+# TRAINSOURCE ` + train.Source + `
 # Generated by sysup: Do not modify directly
 # Use "sysup -list-trains" and "sysup -change-train <trainname>" to modify.
 
 ` + train.Name + `: {
   url: "` + train.PkgURL + `",
   signature_type: "pubkey",
-  pubkey: "/usr/share/keys/train-pkg.key",
+  pubkey: "` + defines.TrainPkgKey + `",
   enabled: yes
 }
 `
-	ioutil.WriteFile("/etc/pkg/Train.conf", []byte(fdata), 0644)
+}
 
+// Switch the pkg repo configuration over to the new train
+//
+// The previous configuration is saved first so it can be restored with
+// -revert-train, and the new files are staged next to their targets so
+// nothing is replaced until everything has been written
+func createnewpkgconf(train defines.TrainDef) error {
+	staged, err := stagerepofiles(map[string][]byte{
+		defines.TrainPkgKey: []byte(strings.Join(train.PkgKey, "\n")),
+		defines.TrainConf:   []byte(trainpkgconf(train)),
+	})
+	if err != nil {
+		return err
+	}
+	defer cleanupstaged(staged)
+
+	// Save what we have now before touching anything
+	if err := backuprepos(); err != nil {
+		return errors.New("Failed backing up repo configs: " + err.Error())
+	}
+
+	// The key has to be in place before the conf that references it
+	if err := commitstaged(
+		staged, defines.TrainPkgKey, defines.TrainConf,
+	); err != nil {
+		return err
+	}
+
+	// Disable any other repos the admin hasn't asked us to keep
+	return removerepos(map[string]bool{filepath.Base(defines.TrainConf): true})
 }
 
 func DoSetTrain(message []byte) {
@@ -232,8 +397,17 @@ func DoSetTrain(message []byte) {
 	var newtrain = s.Train
 
 	// Load the current train list
-	trainlist, err := loadtrains()
+	trainlist, shadowed, err := mergetrains(false)
 	if err != nil {
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+	if src, ok := shadowed[newtrain]; ok {
+		ws.SendMsg(
+			"Train source "+src+" can't be reached and may define train "+
+				newtrain+", refusing to set it",
+			"fatal",
+		)
 		return
 	}
 
@@ -255,9 +429,31 @@ func DoSetTrain(message []byte) {
 		ws.SendMsg("Train missing PkgURL", "fatal")
 		return
 	}
+	if reason := checkpolicy(trains[foundt]); reason != "" {
+		ws.SendMsg("Train "+newtrain+" is not allowed: "+reason, "fatal")
+		return
+	}
+	if trains[foundt].Incompatible != "" {
+		ws.SendMsg(
+			"Train "+newtrain+" is not compatible with this system: "+
+				trains[foundt].Incompatible,
+			"fatal",
+		)
+		return
+	}
+
+	// Only show what would change
+	if s.Preview {
+		previewtrain(trains[foundt])
+		return
+	}
 
 	// Set the new train config file
-	createnewpkgconf(trains[foundt])
+	if err := createnewpkgconf(trains[foundt]); err != nil {
+		logger.LogToFile("Failed setting train: " + err.Error())
+		ws.SendMsg("Failed setting train: "+err.Error(), "fatal")
+		return
+	}
 
 	// Send back confirmation
 	type JSONReply struct {
@@ -0,0 +1,116 @@
+package update
+
+import (
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"os/exec"
+	"strings"
+)
+
+// ZFS user properties we keep on boot-environments
+const (
+	// Unix time sysup created the BE
+	propcreated = "sysup:created"
+	// Set to "yes" to keep the BE from being pruned
+	proppinned = "sysup:pinned"
+	// BE the update was staged from
+	propfrom = "sysup:from"
+	// JSON package summary of the update
+	propsummary = "sysup:summary"
+)
+
+// Boot-environment as listed by beadm
+type beinfo struct {
+	name       string
+	active     string
+	mountpoint string
+	space      string
+	created    string
+}
+
+// Get the boot-environments on the system
+func listbes() ([]beinfo, error) {
+	out, err := exec.Command(defines.BEBIN, "list", "-H").CombinedOutput()
+	if err != nil {
+		return nil, errors.New(
+			"Failed listing boot-environments: " + string(out),
+		)
+	}
+
+	var bes []beinfo
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			fields = strings.Fields(line)
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		be := beinfo{name: fields[0], active: fields[1]}
+		if len(fields) >= 5 {
+			be.mountpoint = fields[2]
+			be.space = fields[3]
+			be.created = strings.Join(fields[4:], " ")
+		}
+		bes = append(bes, be)
+	}
+	return bes, nil
+}
+
+// Look up a boot-environment by name
+func findbe(bes []beinfo, name string) (beinfo, bool) {
+	for _, be := range bes {
+		if be.name == name {
+			return be, true
+		}
+	}
+	return beinfo{}, false
+}
+
+// Set a ZFS user property on a boot-environment
+func setbeprop(be string, prop string, value string) error {
+	out, err := exec.Command(
+		"zfs", "set", prop+"="+value, getberoot()+"/"+be,
+	).CombinedOutput()
+	if err != nil {
+		return errors.New(
+			"Failed setting " + prop + " on " + be + ": " + string(out),
+		)
+	}
+	return nil
+}
+
+// Get our ZFS user properties for every boot-environment, as
+// BE -> property -> value. Unset properties are left out.
+func getbeprops() (map[string]map[string]string, error) {
+	beroot := getberoot()
+	out, err := exec.Command(
+		"zfs", "get", "-H", "-d", "1", "-o", "name,property,value",
+		strings.Join(
+			[]string{propcreated, proppinned, propfrom, propsummary}, ",",
+		),
+		beroot,
+	).CombinedOutput()
+	if err != nil {
+		return nil, errors.New(
+			"Failed reading boot-environment properties: " + string(out),
+		)
+	}
+
+	props := make(map[string]map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], beroot+"/") {
+			continue
+		}
+		if fields[2] == "-" {
+			continue
+		}
+		be := strings.TrimPrefix(fields[0], beroot+"/")
+		if props[be] == nil {
+			props[be] = make(map[string]string)
+		}
+		props[be][fields[1]] = fields[2]
+	}
+	return props, nil
+}
@@ -0,0 +1,280 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/ws"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Record where a new BE came from, so we can report on it later
+func markbe(be string, info defines.StageInfo) {
+	props := map[string]string{
+		propcreated: strconv.FormatInt(info.StagedAt.Unix(), 10),
+		propfrom:    info.OldBEName,
+	}
+	if d := info.Details; d != nil {
+		summary, err := json.Marshal(&defines.PkgSummary{
+			Up:        len(d.Up),
+			Down:      len(d.Down),
+			New:       len(d.New),
+			Reinstall: len(d.Ri),
+			Delete:    len(d.Del),
+		})
+		if err == nil {
+			props[propsummary] = string(summary)
+		}
+	}
+	for prop, value := range props {
+		if err := setbeprop(be, prop, value); err != nil {
+			logger.LogToFile(err.Error())
+		}
+	}
+}
+
+// Get every boot-environment along with our details on it
+func getbeinfo() ([]defines.BEInfo, error) {
+	bes, err := listbes()
+	if err != nil {
+		return nil, err
+	}
+	props, err := getbeprops()
+	if err != nil {
+		return nil, err
+	}
+	var pending string
+	if p := GetPending(); p != nil {
+		pending = p.BEName
+	}
+
+	var list []defines.BEInfo
+	for _, be := range bes {
+		p := props[be.name]
+		info := defines.BEInfo{
+			Name:       be.name,
+			Mountpoint: be.mountpoint,
+			Space:      be.space,
+			Created:    be.created,
+			Current:    strings.Contains(be.active, "N"),
+			NextBoot:   strings.Contains(be.active, "R"),
+			Pending:    be.name == pending,
+			Pinned:     p[proppinned] == "yes",
+			SysUp:      p[propcreated] != "",
+			From:       p[propfrom],
+		}
+		if p[propsummary] != "" {
+			var summary defines.PkgSummary
+			if err := json.Unmarshal([]byte(p[propsummary]), &summary); err == nil {
+				info.Summary = &summary
+			}
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+// Look up a BE, failing if it doesn't exist
+func getbe(name string) (defines.BEInfo, error) {
+	list, err := getbeinfo()
+	if err != nil {
+		return defines.BEInfo{}, err
+	}
+	for _, be := range list {
+		if be.Name == name {
+			return be, nil
+		}
+	}
+	return defines.BEInfo{}, errors.New("No such boot-environment: " + name)
+}
+
+// Characters ZFS allows in a dataset name, and not starting with an option
+var benamere = regexp.MustCompile(`^[A-Za-z0-9_.:][A-Za-z0-9_.:-]*$`)
+
+// Check a name is something beadm and ZFS will accept
+func validbename(name string) error {
+	if name == "" {
+		return errors.New("Missing boot-environment name")
+	}
+	if !benamere.MatchString(name) {
+		return errors.New("Invalid boot-environment name: " + name)
+	}
+	return nil
+}
+
+func runbeadm(args ...string) error {
+	out, err := exec.Command(defines.BEBIN, args...).CombinedOutput()
+	if err != nil {
+		return errors.New(
+			"Failed " + defines.BEBIN + " " + strings.Join(args, " ") + ": " +
+				strings.TrimSpace(string(out)),
+		)
+	}
+	return nil
+}
+
+func activatebe(name string) error {
+	if _, err := getbe(name); err != nil {
+		return err
+	}
+	return runbeadm("activate", name)
+}
+
+func berename(name string, newname string) error {
+	if err := validbename(newname); err != nil {
+		return err
+	}
+	be, err := getbe(name)
+	if err != nil {
+		return err
+	}
+	if be.Current {
+		return errors.New("Can not rename the running boot-environment")
+	}
+	// Stage 2 activates the staged update by the name it was given
+	if be.Pending {
+		return errors.New(
+			"Can not rename the boot-environment of the staged update, " +
+				"cancel it with -cancel-staged first",
+		)
+	}
+	return runbeadm("rename", name, newname)
+}
+
+func pinbe(name string, pin bool) error {
+	if _, err := getbe(name); err != nil {
+		return err
+	}
+	if pin {
+		return setbeprop(name, proppinned, "yes")
+	}
+	out, err := exec.Command(
+		"zfs", "inherit", proppinned, getberoot()+"/"+name,
+	).CombinedOutput()
+	if err != nil {
+		return errors.New(
+			"Failed unpinning " + name + ": " + string(out),
+		)
+	}
+	return nil
+}
+
+func destroybe(name string) error {
+	be, err := getbe(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case be.Current:
+		return errors.New("Can not destroy the running boot-environment")
+	case be.NextBoot:
+		return errors.New(
+			"Can not destroy the boot-environment used on the next boot",
+		)
+	case be.Pinned:
+		return errors.New(name + " is pinned, unpin it first")
+	case be.Pending:
+		return errors.New(
+			name + " holds a staged update, use -cancel-staged instead",
+		)
+	}
+	return runbeadm("destroy", "-F", name)
+}
+
+// Reply to a BE request with the BE it acted on
+func sendbereply(method string, bename string) {
+	type JSONReply struct {
+		Method string `json:"method"`
+		BEName string `json:"bename"`
+	}
+
+	msg, err := json.Marshal(&JSONReply{Method: method, BEName: bename})
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func DoListBEs() {
+	list, err := getbeinfo()
+	if err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+
+	type JSONReply struct {
+		Method string           `json:"method"`
+		BEs    []defines.BEInfo `json:"bes"`
+	}
+
+	msg, err := json.Marshal(&JSONReply{Method: "listbes", BEs: list})
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// What the BE requests do, replaceable so tests can fake it
+type beactions struct {
+	activate func(name string) error
+	rename   func(name string, newname string) error
+	pin      func(name string, pin bool) error
+	destroy  func(name string) error
+}
+
+var bemanager = beactions{
+	activate: activatebe,
+	rename:   berename,
+	pin:      pinbe,
+	destroy:  destroybe,
+}
+
+// Run a BE request, returning its method and the BE it acted on
+func managebe(message []byte) (string, string, error) {
+	// The method is in SendReq, an embedded Envelope would shadow it
+	var s defines.SendReq
+	if err := json.Unmarshal(message, &s); err != nil {
+		return "", "", err
+	}
+
+	method := strings.ToLower(s.Method)
+	switch method {
+	case "activatebe":
+		return method, s.Bename, bemanager.activate(s.Bename)
+	case "renamebe":
+		return method, s.NewName, bemanager.rename(s.Bename, s.NewName)
+	case "pinbe":
+		return method, s.Bename, bemanager.pin(s.Bename, s.Pin)
+	case "destroybe":
+		return method, s.Bename, bemanager.destroy(s.Bename)
+	}
+	return method, s.Bename, errors.New("Unknown method: " + method)
+}
+
+// Handle the activatebe, renamebe, pinbe and destroybe requests
+func DoManageBE(message []byte) {
+	method, bename, err := managebe(message)
+	if err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+
+	logger.LogToFile(method + ": " + bename)
+	sendbereply(method, bename)
+}
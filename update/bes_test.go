@@ -0,0 +1,105 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"testing"
+)
+
+// Replace the BE actions with ones recording what they were asked to do,
+// returning a func putting the real ones back
+func fakebemanager(calls *[]string) func() {
+	old := bemanager
+	bemanager = beactions{
+		activate: func(name string) error {
+			*calls = append(*calls, "activate "+name)
+			return nil
+		},
+		rename: func(name string, newname string) error {
+			*calls = append(*calls, "rename "+name+" "+newname)
+			return nil
+		},
+		pin: func(name string, pin bool) error {
+			if pin {
+				*calls = append(*calls, "pin "+name)
+			} else {
+				*calls = append(*calls, "unpin "+name)
+			}
+			return nil
+		},
+		destroy: func(name string) error {
+			*calls = append(*calls, "destroy "+name)
+			return errors.New("destroy failed")
+		},
+	}
+	return func() { bemanager = old }
+}
+
+func TestManageBE(t *testing.T) {
+	var calls []string
+	defer fakebemanager(&calls)()
+
+	tests := []struct {
+		req    defines.SendReq
+		method string
+		bename string
+		call   string
+		err    bool
+	}{
+		{
+			defines.SendReq{Method: "activatebe", Bename: "13.0_a"},
+			"activatebe", "13.0_a", "activate 13.0_a", false,
+		},
+		{
+			defines.SendReq{
+				Method: "renamebe", Bename: "13.0_a", NewName: "13.0_b",
+			},
+			"renamebe", "13.0_b", "rename 13.0_a 13.0_b", false,
+		},
+		{
+			defines.SendReq{Method: "pinbe", Bename: "13.0_a", Pin: true},
+			"pinbe", "13.0_a", "pin 13.0_a", false,
+		},
+		{
+			defines.SendReq{Method: "pinbe", Bename: "13.0_a"},
+			"pinbe", "13.0_a", "unpin 13.0_a", false,
+		},
+		{
+			defines.SendReq{Method: "destroybe", Bename: "13.0_a"},
+			"destroybe", "13.0_a", "destroy 13.0_a", true,
+		},
+		{
+			defines.SendReq{Method: "DestroyBE", Bename: "13.0_a"},
+			"destroybe", "13.0_a", "destroy 13.0_a", true,
+		},
+		{
+			defines.SendReq{Method: "mountbe", Bename: "13.0_a"},
+			"mountbe", "13.0_a", "", true,
+		},
+	}
+	for _, test := range tests {
+		// Encoded the same way the client sends it
+		msg, err := json.Marshal(&test.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		calls = nil
+		method, bename, err := managebe(msg)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.req.Method, err)
+		}
+		if method != test.method || bename != test.bename {
+			t.Errorf("%s: got %q %q, want %q %q", test.req.Method,
+				method, bename, test.method, test.bename)
+		}
+		var want []string
+		if test.call != "" {
+			want = []string{test.call}
+		}
+		if len(calls) != len(want) || (len(want) > 0 && calls[0] != want[0]) {
+			t.Errorf("%s: called %v, want %v", test.req.Method, calls, want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package update
+
+import (
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/disks"
+	"github.com/trueos/sysup/efiboot"
+	"github.com/trueos/sysup/logger"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Get the boot entry manager, working on a copy of the real entries if we
+// aren't applying any changes
+func bootmanager(apply bool) efiboot.Manager {
+	if apply {
+		return efiboot.DefaultManager
+	}
+	entries, err := efiboot.DefaultManager.List()
+	if err != nil {
+		return &efiboot.Fake{Err: err}
+	}
+	return efiboot.NewFake(entries)
+}
+
+// Pick which of the loaders on a partition the boot entry should boot
+func entrytarget(targets []string) string {
+	if want := defines.EFIBoot.Loader; want != "" {
+		for _, tgt := range targets {
+			if strings.EqualFold(filepath.Clean(tgt), filepath.Clean(want)) {
+				return tgt
+			}
+		}
+	}
+	return targets[0]
+}
+
+// Check if a boot entry is on an EFI partition
+//
+// The partition UUID in the device path is used when we have it, since
+// efibootmgr may map the partition to any of its names
+func ondevice(e efiboot.Entry, part disks.Partition) bool {
+	if e.PartUUID != "" && part.RawUUID != "" {
+		return strings.EqualFold(e.PartUUID, part.RawUUID)
+	}
+	if e.Device == part.Name {
+		return true
+	}
+	for _, alias := range part.Aliases {
+		if e.Device == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// Label of the boot entries we create
+func entrylabel(part disks.Partition) string {
+	return defines.EFIBoot.Label + " (" + part.Name + ")"
+}
+
+// Find the boot entry for a loader
+func findentry(
+	entries []efiboot.Entry, part disks.Partition, path string,
+) (efiboot.Entry, bool) {
+	// FAT doesn't care about case, and the firmware paths are upper case
+	for _, e := range entries {
+		if ondevice(e, part) && strings.EqualFold(e.Path, path) {
+			return e, true
+		}
+	}
+
+	// One we made before, when there are no UUIDs to tell us otherwise,
+	// so an entry efibootmgr names differently isn't created again
+	for _, e := range entries {
+		if e.PartUUID != "" && part.RawUUID != "" {
+			continue
+		}
+		if e.Label == entrylabel(part) && strings.EqualFold(e.Path, path) {
+			return e, true
+		}
+	}
+	return efiboot.Entry{}, false
+}
+
+// Make sure an active boot entry points at the loader tgt on a mounted EFI
+// partition, returning the entry number and what was done
+func ensureentry(
+	mgr efiboot.Manager, part disks.Partition, mnt string, tgt string,
+) (string, []string, error) {
+	var actions []string
+	entries, err := mgr.List()
+	if err != nil {
+		return "", actions, err
+	}
+
+	path := "/" + tgt
+	entry, ok := findentry(entries, part, path)
+	if !ok {
+		label := entrylabel(part)
+		if err := mgr.Create(part.Name, mnt, tgt, label); err != nil {
+			return "", actions, err
+		}
+		actions = append(
+			actions,
+			"Create boot entry \""+label+"\" for "+part.Name+":"+path,
+		)
+		if entries, err = mgr.List(); err != nil {
+			return "", actions, err
+		}
+		if entry, ok = findentry(entries, part, path); !ok {
+			return "", actions, errors.New(
+				"Created boot entry not found for " + part.Name + ":" + path,
+			)
+		}
+	} else if !entry.Active {
+		if err := mgr.Activate(entry.Num); err != nil {
+			return entry.Num, actions, err
+		}
+		actions = append(actions, "Activate Boot"+entry.Num)
+	}
+
+	// Turn off entries on this partition for loaders which are gone, such
+	// as ones left by TrueOS
+	if defines.EFIBoot.DeactivateStale {
+		for _, e := range entries {
+			if e.Num == entry.Num || !e.Active || e.Path == "" ||
+				!ondevice(e, part) {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(mnt, e.Path)); err == nil {
+				continue
+			}
+			if err := mgr.Deactivate(e.Num); err != nil {
+				return entry.Num, actions, err
+			}
+			actions = append(
+				actions,
+				"Deactivate stale Boot"+e.Num+" \""+e.Label+"\"",
+			)
+		}
+	}
+	return entry.Num, actions, nil
+}
+
+// Point the firmware at the loader just written to an EFI partition
+func setupentry(
+	mgr efiboot.Manager, list []defines.BootPart, part disks.Partition,
+	mnt string, targets []string,
+) {
+	tgt := entrytarget(targets)
+	for i := range list {
+		bp := &list[i]
+		if bp.Target != tgt || bp.Result == "failed" || bp.Error != "" {
+			continue
+		}
+		num, actions, err := ensureentry(mgr, part, mnt, tgt)
+		if num != "" {
+			bp.BootEntry = "Boot" + num
+		}
+		bp.BootActions = actions
+		for _, action := range actions {
+			logger.LogToFile(action)
+		}
+		if err != nil {
+			bp.BootError = err.Error()
+			logger.LogToFile("Failed updating boot entries: " + err.Error())
+		}
+		return
+	}
+}
+
+// Have the firmware try the first updated loader once on the next boot,
+// only noting it as a planned action if apply isn't set
+func setbootnext(
+	mgr efiboot.Manager, report *defines.LoaderReport, apply bool,
+) {
+	for i := range report.Disks {
+		for j := range report.Disks[i].Partitions {
+			bp := &report.Disks[i].Partitions[j]
+			if bp.BootEntry == "" || bp.BootError != "" {
+				continue
+			}
+			if !apply {
+				bp.BootActions = append(
+					bp.BootActions, "Set BootNext to "+bp.BootEntry,
+				)
+				return
+			}
+			num := strings.TrimPrefix(bp.BootEntry, "Boot")
+			if err := mgr.SetBootNext(num); err != nil {
+				bp.BootError = err.Error()
+				logger.LogToFile("Failed setting BootNext: " + err.Error())
+				return
+			}
+			report.BootNext = bp.BootEntry
+			logger.LogToFile("Set BootNext to " + bp.BootEntry)
+			return
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package update
+
+import (
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/disks"
+	"github.com/trueos/sysup/efiboot"
+	"testing"
+)
+
+const espuuid = "f859c46d-19ee-4e40-8975-3ad1ab00ac09"
+
+// Use conf as the boot entry config, returning a func putting the old one
+// back
+func setefiboot(conf defines.EFIBootConfig) func() {
+	old := defines.EFIBoot
+	defines.EFIBoot = &conf
+	return func() { defines.EFIBoot = old }
+}
+
+func esppart() disks.Partition {
+	return disks.Partition{
+		Name:    "ada0p1",
+		Index:   1,
+		Type:    "efi",
+		RawUUID: espuuid,
+		Aliases: []string{"gpt/efiboot0", "gptid/" + espuuid},
+	}
+}
+
+func TestEnsureEntryCreatesOnce(t *testing.T) {
+	defer setefiboot(defines.EFIBootConfig{Label: "FreeBSD"})()
+	tgt := "efi/freebsd/loader.efi"
+	mnt, cleanup := fakeesp(t, map[string]string{tgt: "loader"})
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		part    disks.Partition
+		uuids   map[string]string
+		devices map[string]string
+	}{
+		{
+			"firmware maps the partition to its diskid name",
+			esppart(),
+			map[string]string{"ada0p1": espuuid},
+			map[string]string{"ada0p1": "diskid/DISK-S3Z1NB0K100001Ap1"},
+		},
+		{
+			"no partition UUID",
+			disks.Partition{Name: "ada0s1", Index: 1, Type: "efi"},
+			nil,
+			map[string]string{"ada0s1": "diskid/DISK-S3Z1NB0K100001As1"},
+		},
+		{
+			"firmware uses a label",
+			esppart(),
+			nil,
+			map[string]string{"ada0p1": "gpt/efiboot0"},
+		},
+	}
+	for _, test := range tests {
+		mgr := efiboot.NewFake([]efiboot.Entry{
+			{Num: "0000", Label: "Windows Boot Manager", Active: true,
+				Device: "ada1p2", Path: "/EFI/Microsoft/Boot/bootmgfw.efi",
+				PartUUID: "0b5b8e56-3e2d-4b1c-9a4f-52e0a1f4e9ab"},
+		})
+		mgr.UUIDs = test.uuids
+		mgr.Devices = test.devices
+
+		num, actions, err := ensureentry(mgr, test.part, mnt, tgt)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if num != "0001" || len(actions) != 1 {
+			t.Errorf("%s: got Boot%s %v, want a new Boot0001",
+				test.name, num, actions)
+		}
+
+		// Running again finds the entry just made
+		num, actions, err = ensureentry(mgr, test.part, mnt, tgt)
+		if err != nil || num != "0001" || len(actions) != 0 {
+			t.Errorf("%s: second run got Boot%s %v %v",
+				test.name, num, actions, err)
+		}
+		if len(mgr.Entries) != 2 {
+			t.Errorf("%s: %d entries, want 2", test.name, len(mgr.Entries))
+		}
+	}
+}
+
+func TestEnsureEntryExisting(t *testing.T) {
+	defer setefiboot(defines.EFIBootConfig{
+		Label: "FreeBSD", DeactivateStale: true,
+	})()
+	tgt := "efi/freebsd/loader.efi"
+	mnt, cleanup := fakeesp(t, map[string]string{
+		tgt:                    "loader",
+		"efi/boot/bootx64.efi": "loader",
+	})
+	defer cleanup()
+
+	mgr := efiboot.NewFake([]efiboot.Entry{
+		// Ours, under another name, but turned off
+		{Num: "0004", Label: "FreeBSD", Device: "diskid/DISK-1p1",
+			Path: "/EFI/FREEBSD/LOADER.EFI", PartUUID: espuuid},
+		// Loader which has gone from the partition
+		{Num: "0002", Label: "TrueOS", Active: true,
+			Path: "/EFI/BOOT/BOOTX64-TRUEOS.EFI", PartUUID: espuuid},
+		// Loader still there, msdosfs ignores case but the test dir may not
+		{Num: "0003", Label: "Fallback", Active: true,
+			Path: "/efi/boot/bootx64.efi", PartUUID: espuuid},
+		// Same path on another disk
+		{Num: "0005", Label: "FreeBSD", Active: true, Device: "ada1p1",
+			Path:     "/EFI/FREEBSD/GONE.EFI",
+			PartUUID: "1c4a3d3e-5b0f-4bde-9d36-6a3a3f0d2e11"},
+	})
+
+	num, actions, err := ensureentry(mgr, esppart(), mnt, tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != "0004" {
+		t.Fatalf("got Boot%s, want Boot0004", num)
+	}
+	want := []string{
+		"Activate Boot0004", "Deactivate stale Boot0002 \"TrueOS\"",
+	}
+	if len(actions) != len(want) {
+		t.Fatalf("actions = %v, want %v", actions, want)
+	}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Errorf("action %d = %q, want %q", i, actions[i], want[i])
+		}
+	}
+
+	active := map[string]bool{}
+	for _, e := range mgr.Entries {
+		active[e.Num] = e.Active
+	}
+	if !active["0004"] || active["0002"] || !active["0003"] ||
+		!active["0005"] {
+		t.Errorf("active entries = %v", active)
+	}
+}
+
+func TestSetupEntry(t *testing.T) {
+	defer setefiboot(defines.EFIBootConfig{
+		Label: "FreeBSD", Loader: "EFI/FreeBSD/loader.efi",
+	})()
+	mnt, cleanup := fakeesp(t, map[string]string{})
+	defer cleanup()
+	targets := []string{"efi/boot/bootx64-trueos.efi", "efi/freebsd/loader.efi"}
+
+	mgr := efiboot.NewFake(nil)
+	list := []defines.BootPart{
+		{Partition: "ada0p1", Target: targets[0], Result: "updated"},
+		{Partition: "ada0p1", Target: targets[1], Result: "updated"},
+	}
+	setupentry(mgr, list, esppart(), mnt, targets)
+	if list[0].BootEntry != "" {
+		t.Errorf("boot entry made for %s", targets[0])
+	}
+	if list[1].BootEntry != "Boot0000" || list[1].BootError != "" {
+		t.Errorf("got %+v, want Boot0000 for %s", list[1], targets[1])
+	}
+
+	// Nothing points at a loader which failed to install
+	mgr = efiboot.NewFake(nil)
+	list[1] = defines.BootPart{
+		Partition: "ada0p1", Target: targets[1], Result: "failed",
+		Error: "Checksum mismatch",
+	}
+	setupentry(mgr, list, esppart(), mnt, targets)
+	if list[1].BootEntry != "" || len(mgr.Entries) != 0 {
+		t.Errorf("boot entry made for a failed loader: %+v", mgr.Entries)
+	}
+}
+
+func TestSetBootNext(t *testing.T) {
+	mgr := efiboot.NewFake([]efiboot.Entry{
+		{Num: "0000", Active: true}, {Num: "0001", Active: true},
+	})
+	report := defines.LoaderReport{Disks: []defines.BootDisk{
+		{Disk: "ada0", Partitions: []defines.BootPart{
+			{Partition: "ada0p1", BootEntry: "Boot0000",
+				BootError: "Failed efibootmgr"},
+		}},
+		{Disk: "ada1", Partitions: []defines.BootPart{
+			{Partition: "ada1p1", BootEntry: "Boot0001"},
+		}},
+	}}
+
+	// A dry-run only plans it
+	setbootnext(mgr, &report, false)
+	if mgr.BootNext != "" || report.BootNext != "" {
+		t.Fatalf("dry-run set BootNext %q, reported %q",
+			mgr.BootNext, report.BootNext)
+	}
+	actions := report.Disks[1].Partitions[0].BootActions
+	if len(actions) != 1 || actions[0] != "Set BootNext to Boot0001" {
+		t.Fatalf("planned actions = %v", actions)
+	}
+
+	setbootnext(mgr, &report, true)
+	if mgr.BootNext != "0001" || report.BootNext != "Boot0001" {
+		t.Fatalf("BootNext = %q, reported %q, want 0001",
+			mgr.BootNext, report.BootNext)
+	}
+}
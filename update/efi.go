@@ -0,0 +1,339 @@
+package update
+
+import (
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/disks"
+	"github.com/trueos/sysup/efiboot"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/ws"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Find a device by any of its names in "mount -p" output, returning where
+// it is mounted and if it is mounted read-only
+func findmount(out string, names map[string]bool) (string, bool) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !names[fields[0]] {
+			continue
+		}
+		readonly := false
+		if len(fields) >= 4 {
+			for _, opt := range strings.Split(fields[3], ",") {
+				if opt == "ro" {
+					readonly = true
+				}
+			}
+		}
+		return fields[1], readonly
+	}
+	return "", false
+}
+
+// Get where an EFI partition is already mounted, if anywhere, and if that
+// mount is read-only
+func espmounted(part disks.Partition) (string, bool) {
+	out, err := exec.Command("mount", "-p").Output()
+	if err != nil {
+		return "", false
+	}
+	names := map[string]bool{part.Dev(): true}
+	for _, alias := range part.Aliases {
+		names["/dev/"+alias] = true
+	}
+	return findmount(string(out), names)
+}
+
+// Change an existing mount between read-only and read-write
+func remount(mnt string, opt string) error {
+	out, err := exec.Command("mount", "-u", "-o", opt, mnt).CombinedOutput()
+	if err != nil {
+		return errors.New(
+			"Unable to remount " + mnt + " " + opt + ": " +
+				strings.TrimSpace(string(out)),
+		)
+	}
+	return nil
+}
+
+// Mount an EFI partition on a temporary directory, or use the existing mount
+// if it is already mounted, returning a function to undo the mount
+func mountesp(part disks.Partition, readonly bool) (string, func(), error) {
+	if mnt, ro := espmounted(part); mnt != "" {
+		if !ro || readonly {
+			return mnt, func() {}, nil
+		}
+
+		// Only write to it for as long as we need to
+		if err := remount(mnt, "rw"); err != nil {
+			return "", nil, err
+		}
+		return mnt, func() {
+			if err := remount(mnt, "ro"); err != nil {
+				logger.LogToFile(err.Error())
+			}
+		}, nil
+	}
+
+	mnt, err := ioutil.TempDir("", "sysup-efi")
+	if err != nil {
+		return "", nil, errors.New(
+			"Failed creating mount point: " + err.Error(),
+		)
+	}
+	args := []string{"-t", "msdosfs"}
+	if readonly {
+		args = append(args, "-o", "ro")
+	}
+	args = append(args, part.Dev(), mnt)
+	out, err := exec.Command("mount", args...).CombinedOutput()
+	if err != nil {
+		os.Remove(mnt)
+		return "", nil, errors.New(
+			"Unable to mount EFI partition " + part.Dev() + ": " +
+				strings.TrimSpace(string(out)),
+		)
+	}
+	return mnt, func() {
+		if out, err := exec.Command(
+			"umount", mnt,
+		).CombinedOutput(); err != nil {
+			logger.LogToFile(
+				"Unable to umount EFI partition " + part.Name + ": " +
+					string(out),
+			)
+			return
+		}
+		os.Remove(mnt)
+	}, nil
+}
+
+// Check if a file exists on a mounted EFI partition
+func onesp(mnt string, path string) bool {
+	_, err := os.Stat(filepath.Join(mnt, path))
+	return err == nil
+}
+
+// Check if the removable media loader on a mounted EFI partition is a
+// FreeBSD loader, going by the marker file or by it matching a loader we
+// know: the staged one, the running one or one of our own targets
+func ourfallback(mnt string, targets []string, staged string) bool {
+	if onesp(mnt, defines.EFIFallbackMarker) {
+		return true
+	}
+	sum, err := hashfile(filepath.Join(mnt, defines.EFIFallback), 0)
+	if err != nil {
+		return false
+	}
+	known := []string{staged, "/boot/loader.efi"}
+	for _, tgt := range targets {
+		known = append(known, filepath.Join(mnt, tgt))
+	}
+	for _, path := range known {
+		if hash, err := hashfile(path, 0); err == nil && hash == sum {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the loader files on a mounted EFI partition to replace, every
+// configured target which exists, or else the first target. Also returned
+// is the removable media loader if it exists and isn't known to be ours.
+func efitargets(mnt string, staged string) ([]string, string) {
+	var targets []string
+	listed := false
+	for _, tgt := range defines.EFITargets {
+		if tgt == defines.EFIFallback {
+			listed = true
+		}
+		if onesp(mnt, tgt) {
+			targets = append(targets, tgt)
+		}
+	}
+
+	var skipped string
+	if !listed && onesp(mnt, defines.EFIFallback) {
+		if ourfallback(mnt, targets, staged) {
+			targets = append(targets, defines.EFIFallback)
+		} else {
+			skipped = defines.EFIFallback
+		}
+	}
+
+	if len(targets) == 0 && len(defines.EFITargets) > 0 {
+		targets = append(targets, defines.EFITargets[0])
+	}
+	return targets, skipped
+}
+
+// Copy a file and make sure it has reached the disk
+func copysync(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Flush a directory so a rename in it reaches the disk
+func syncdir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Replace an EFI loader without ever leaving it half written
+//
+// The new loader is written next to the old one and checked, the old loader
+// is kept as .bak and then the new one is renamed into place
+func installefi(path string, staged string, hash string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.New("Failed mkdir " + filepath.Dir(path))
+	}
+
+	tmp := path + ".new"
+	if err := copysync(staged, tmp); err != nil {
+		os.Remove(tmp)
+		return errors.New("Unable to write " + tmp + ": " + err.Error())
+	}
+	if sum, err := hashfile(tmp, 0); err != nil || sum != hash {
+		os.Remove(tmp)
+		return errors.New("Checksum mismatch after writing " + tmp)
+	}
+
+	// Keep the loader we are replacing
+	backup := path + ".bak"
+	backedup := false
+	if _, err := os.Stat(path); err == nil {
+		if err := copysync(path, backup); err != nil {
+			os.Remove(tmp)
+			return errors.New(
+				"Unable to back up " + path + ": " + err.Error(),
+			)
+		}
+		backedup = true
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.New("Unable to replace " + path + ": " + err.Error())
+	}
+	syncdir(filepath.Dir(path))
+
+	if sum, err := hashfile(path, 0); err != nil || sum != hash {
+		// Put back what was there before, a .bak from some earlier run
+		// is no better than nothing
+		if backedup {
+			copysync(backup, path)
+		} else {
+			os.Remove(path)
+		}
+		return errors.New("Checksum mismatch after replacing " + path)
+	}
+	return nil
+}
+
+// Work out what updating each loader on an EFI partition would do, doing it
+// if apply is set
+func runefi(
+	part disks.Partition, stagedir string, apply bool, mgr efiboot.Manager,
+) []defines.BootPart {
+	staged := stagedir + "/boot/loader.efi"
+	base := defines.BootPart{
+		Partition: part.Name,
+		Index:     part.Index,
+		Type:      part.Type,
+		Action:    "none",
+	}
+
+	hash, err := hashfile(staged, 0)
+	if err != nil {
+		base.Error = "Unable to read " + staged
+		setresult(&base, apply)
+		return []defines.BootPart{base}
+	}
+	base.Staged = &defines.LoaderFile{Path: staged, SHA256: hash}
+
+	mnt, unmount, err := mountesp(part, !apply)
+	if err != nil {
+		base.Error = err.Error()
+		setresult(&base, apply)
+		return []defines.BootPart{base}
+	}
+	defer unmount()
+
+	var list []defines.BootPart
+	targets, skipped := efitargets(mnt, staged)
+	for _, tgt := range targets {
+		bp := base
+		bp.Target = tgt
+		bp.Current = &defines.LoaderFile{Path: tgt}
+		if sum, err := hashfile(filepath.Join(mnt, tgt), 0); err == nil {
+			bp.Current.SHA256 = sum
+		}
+		bp.UpToDate = bp.Current.SHA256 == hash
+		bp.Action = "Copy " + staged + " to " + tgt + " on " + part.Dev() +
+			", keeping the old loader as " + tgt + ".bak"
+		if bp.UpToDate {
+			bp.Action = "none"
+		}
+
+		if apply && bp.UpToDate {
+			bp.Result = "uptodate"
+		} else if apply {
+			logger.LogToFile(
+				"Updating EFI bootloader on: " + part.Name + " " + tgt,
+			)
+			ws.SendMsg("Updating EFI bootloader on: " + part.Name + " " + tgt)
+			if err := installefi(
+				filepath.Join(mnt, tgt), staged, hash,
+			); err != nil {
+				bp.Error = err.Error()
+			}
+			setresult(&bp, apply)
+		}
+		list = append(list, bp)
+	}
+
+	// Let the admin know why the removable media loader was left alone
+	if skipped != "" {
+		bp := base
+		bp.Target = skipped
+		bp.Current = &defines.LoaderFile{Path: skipped}
+		if sum, err := hashfile(filepath.Join(mnt, skipped), 0); err == nil {
+			bp.Current.SHA256 = sum
+		}
+		bp.Action = "none, not a known FreeBSD loader"
+		if apply {
+			bp.Result = "skipped"
+		}
+		list = append(list, bp)
+	}
+
+	if mgr != nil && len(targets) > 0 {
+		setupentry(mgr, list, part, mnt, targets)
+	}
+	return list
+}
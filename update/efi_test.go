@@ -0,0 +1,217 @@
+package update
+
+import (
+	"github.com/trueos/sysup/defines"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Create a fake EFI partition with the given files on it, returning its
+// mountpoint and a func removing it
+func fakeesp(t *testing.T, files map[string]string) (string, func()) {
+	mnt, err := ioutil.TempDir("", "sysup-esp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(mnt) }
+	for name, data := range files {
+		path := filepath.Join(mnt, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	return mnt, cleanup
+}
+
+func TestEFITargets(t *testing.T) {
+	staged, cleanstaged := fakeesp(
+		t, map[string]string{"boot/loader.efi": "new loader"},
+	)
+	defer cleanstaged()
+	stagedloader := filepath.Join(staged, "boot/loader.efi")
+
+	tests := []struct {
+		name    string
+		conf    []string
+		files   map[string]string
+		targets []string
+		skipped string
+	}{
+		{
+			"empty partition gets the first target",
+			nil,
+			map[string]string{},
+			[]string{"efi/freebsd/loader.efi"},
+			"",
+		},
+		{
+			"another OS owns the fallback loader",
+			nil,
+			map[string]string{
+				"efi/boot/bootx64.efi":      "windows boot manager",
+				"efi/freebsd/loader.efi":    "old loader",
+				"efi/microsoft/bootmgr.efi": "windows boot manager",
+			},
+			[]string{"efi/freebsd/loader.efi"},
+			"efi/boot/bootx64.efi",
+		},
+		{
+			"fallback loader is a copy of ours",
+			nil,
+			map[string]string{
+				"efi/boot/bootx64.efi":   "old loader",
+				"efi/freebsd/loader.efi": "old loader",
+			},
+			[]string{"efi/freebsd/loader.efi", "efi/boot/bootx64.efi"},
+			"",
+		},
+		{
+			"fallback loader already updated",
+			nil,
+			map[string]string{"efi/boot/bootx64.efi": "new loader"},
+			[]string{"efi/boot/bootx64.efi"},
+			"",
+		},
+		{
+			"marker file",
+			nil,
+			map[string]string{
+				"efi/boot/bootx64.efi":        "old trueos loader",
+				"efi/boot/bootx64-trueos.efi": "older trueos loader",
+			},
+			[]string{"efi/boot/bootx64-trueos.efi", "efi/boot/bootx64.efi"},
+			"",
+		},
+		{
+			"fallback loader opted in",
+			[]string{"efi/boot/bootx64.efi", "efi/freebsd/loader.efi"},
+			map[string]string{"efi/boot/bootx64.efi": "grub"},
+			[]string{"efi/boot/bootx64.efi"},
+			"",
+		},
+	}
+	defaults := defines.EFITargets
+	defer func() { defines.EFITargets = defaults }()
+	for _, test := range tests {
+		defines.EFITargets = defaults
+		if test.conf != nil {
+			defines.EFITargets = test.conf
+		}
+		mnt, cleanup := fakeesp(t, test.files)
+		targets, skipped := efitargets(mnt, stagedloader)
+		cleanup()
+		if !reflect.DeepEqual(targets, test.targets) {
+			t.Errorf("%s: targets = %v, want %v",
+				test.name, targets, test.targets)
+		}
+		if skipped != test.skipped {
+			t.Errorf("%s: skipped = %q, want %q",
+				test.name, skipped, test.skipped)
+		}
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	out := "/dev/ada0p4\t\t/\t\tzfs\trw\t\t0 0\n" +
+		"/dev/gpt/efiboot0\t\t/boot/efi\t\tmsdosfs\tro,noatime\t\t2 2\n" +
+		"/dev/ada1p2\t\t/mnt/efi\t\tmsdosfs\trw\t\t2 2\n"
+
+	tests := []struct {
+		names    []string
+		mnt      string
+		readonly bool
+	}{
+		{[]string{"/dev/ada0p2", "/dev/gpt/efiboot0"}, "/boot/efi", true},
+		{[]string{"/dev/ada1p2", "/dev/gpt/efiboot1"}, "/mnt/efi", false},
+		{[]string{"/dev/ada2p2"}, "", false},
+	}
+	for _, test := range tests {
+		names := make(map[string]bool)
+		for _, name := range test.names {
+			names[name] = true
+		}
+		mnt, readonly := findmount(out, names)
+		if mnt != test.mnt || readonly != test.readonly {
+			t.Errorf("%v: got %q %v, want %q %v", test.names,
+				mnt, readonly, test.mnt, test.readonly)
+		}
+	}
+}
+
+func readfile(t *testing.T, path string) string {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(dat)
+}
+
+func TestInstallEFI(t *testing.T) {
+	staged, cleanstaged := fakeesp(
+		t, map[string]string{"boot/loader.efi": "new loader"},
+	)
+	defer cleanstaged()
+	stagedloader := filepath.Join(staged, "boot/loader.efi")
+	hash, err := hashfile(stagedloader, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing a loader keeps the old one
+	mnt, cleanup := fakeesp(t, map[string]string{
+		"efi/freebsd/loader.efi": "old loader",
+	})
+	defer cleanup()
+	path := filepath.Join(mnt, "efi/freebsd/loader.efi")
+	if err := installefi(path, stagedloader, hash); err != nil {
+		t.Fatal(err)
+	}
+	if got := readfile(t, path); got != "new loader" {
+		t.Errorf("loader = %q, want the new loader", got)
+	}
+	if got := readfile(t, path+".bak"); got != "old loader" {
+		t.Errorf("backup = %q, want the old loader", got)
+	}
+	if _, err := os.Stat(path + ".new"); err == nil {
+		t.Error("temporary copy left behind")
+	}
+
+	// A bad copy leaves everything alone, including an old backup
+	mnt, cleanup = fakeesp(t, map[string]string{
+		"efi/freebsd/loader.efi":     "old loader",
+		"efi/freebsd/loader.efi.bak": "stale backup",
+	})
+	defer cleanup()
+	path = filepath.Join(mnt, "efi/freebsd/loader.efi")
+	if err := installefi(path, stagedloader, "0123"); err == nil {
+		t.Fatal("installed a loader with the wrong checksum")
+	}
+	if got := readfile(t, path); got != "old loader" {
+		t.Errorf("loader = %q, want the old loader", got)
+	}
+	if got := readfile(t, path+".bak"); got != "stale backup" {
+		t.Errorf("backup = %q, want the stale backup", got)
+	}
+
+	// Nothing to back up on a new loader
+	mnt, cleanup = fakeesp(t, map[string]string{})
+	defer cleanup()
+	path = filepath.Join(mnt, "efi/freebsd/loader.efi")
+	if err := installefi(path, stagedloader, hash); err != nil {
+		t.Fatal(err)
+	}
+	if got := readfile(t, path); got != "new loader" {
+		t.Errorf("loader = %q, want the new loader", got)
+	}
+	if _, err := os.Stat(path + ".bak"); err == nil {
+		t.Error("backup made of a loader which didn't exist")
+	}
+}
@@ -0,0 +1,67 @@
+package update
+
+import (
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/pkg"
+	"github.com/trueos/sysup/trains"
+	"github.com/trueos/sysup/ws"
+	"os/exec"
+	"strings"
+)
+
+// Get the packages autoremove must keep, from the config and current train.
+// Packages which are neither installed nor in the repo are dropped.
+func getessential() []string {
+	names := append([]string{}, defines.EssentialPkgs...)
+	names = append(names, trains.EssentialPkgs()...)
+
+	seen := make(map[string]bool)
+	essential := []string{}
+	var missing []string
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if !pkg.PkgExists(name) {
+			missing = append(missing, name)
+			continue
+		}
+		essential = append(essential, name)
+	}
+
+	if len(missing) > 0 {
+		msg := "Skipping unknown essential packages: " +
+			strings.Join(missing, " ")
+		logger.LogToFile(msg)
+		ws.SendMsg(msg)
+	}
+	logger.LogToFile("Essential packages: " + strings.Join(essential, " "))
+	return essential
+}
+
+// Mark the essential packages as non-automatic so autoremove leaves them
+func markessential(essential []string) {
+	var protected []string
+	for _, name := range essential {
+		if !pkg.PkgInstalled(name) {
+			logger.LogToFile("Essential package not installed: " + name)
+			continue
+		}
+		out, err := exec.Command(
+			defines.PKGBIN, "-C", defines.PkgConf,
+			"set", "-y", "-A", "00", name,
+		).CombinedOutput()
+		logger.LogToFile(string(out))
+		if err != nil {
+			logger.LogToFile("Failed marking essential package: " + name)
+			continue
+		}
+		protected = append(protected, name)
+	}
+
+	msg := "Protected essential packages: " + strings.Join(protected, " ")
+	ws.SendMsg(msg)
+	logger.LogToFile(msg)
+}
@@ -0,0 +1,155 @@
+package update
+
+import (
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/hooks"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/notify"
+	"github.com/trueos/sysup/pkg"
+	"github.com/trueos/sysup/ws"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Snapshot the running boot-environment so a live update can be undone
+func snapshotbe() (string, error) {
+	be := strings.TrimSpace(getcurrentbe())
+	snap := be + "@" + defines.ToolName + "-" +
+		time.Now().Format("2006-01-02-15-04-05")
+
+	out, err := exec.Command(
+		"zfs", "snapshot", "-r", getberoot()+"/"+snap,
+	).CombinedOutput()
+	if err != nil {
+		logger.LogToFile("Failed zfs snapshot: " + string(out))
+		return "", err
+	}
+	logger.LogToFile("Created snapshot: " + snap)
+	return snap, nil
+}
+
+// Get the packages a live update changes, as checked by the user
+//
+// New packages are dependencies pkg pulls in with these, and removals come
+// from these changing, so neither are named
+func livepkgs(details *defines.UpdateInfo) []string {
+	var names []string
+	for _, p := range details.Up {
+		names = append(names, p.Name)
+	}
+	for _, p := range details.Down {
+		names = append(names, p.Name)
+	}
+	for _, p := range details.Ri {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// Upgrade only the planned packages on the running system
+//
+// Unlike a staged update pkg is not reinstalled, the base packages are left
+// alone and orphans are not removed, the running system only gets what the
+// check showed
+func upgradelive(details *defines.UpdateInfo, essential []string) error {
+	ws.SendMsg("Starting live package update")
+	logger.LogToFile("LivePackageUpdate\n-----------------------")
+
+	// The check only refreshed our own copy of the repo catalogs
+	pkg.UpdatePkgDb("")
+
+	names := livepkgs(details)
+	if len(names) == 0 {
+		ws.SendMsg("No packages to upgrade")
+		return nil
+	}
+
+	cmd := exec.Command(
+		defines.PKGBIN, "-C", defines.PkgConf, "upgrade", "-U", "-y",
+	)
+	cmd.Args = append(cmd.Args, names...)
+	logger.LogToFile("Starting live upgrade with: " + strings.Join(cmd.Args, " "))
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		ws.SendMsg(line)
+		logger.LogToFile("pkg: " + line)
+	}
+	if err != nil {
+		errstr := "Failed pkg upgrade: " + err.Error()
+		logger.LogToFile(errstr)
+		ws.SendMsg(errstr, "fatal")
+		return errors.New(errstr)
+	}
+
+	// Mark essential pkgs
+	markessential(essential)
+
+	ws.SendMsg("Finished live package update")
+	logger.LogToFile("FinishedLivePackageUpdate\n-----------------------")
+	return nil
+}
+
+// Apply the update to the running system, without a new boot-environment
+func startlive(details *defines.UpdateInfo) {
+	info := defines.StageInfo{
+		BEName:    strings.TrimSpace(getcurrentbe()),
+		OldBEName: strings.TrimSpace(getcurrentbe()),
+		Details:   details,
+		Essential: getessential(),
+		Only:      defines.OnlyFlag,
+		StagedAt:  time.Now(),
+	}
+	env := hooks.StageEnv(info)
+
+	if err := hooks.Run(hooks.PreLive, env); err != nil {
+		pkg.DestroyMdDev()
+		abortstage(err)
+		return
+	}
+
+	ws.SendMsg("Creating snapshot of the running system")
+	snap, err := snapshotbe()
+	if err != nil {
+		pkg.DestroyMdDev()
+		ws.SendMsg("Failed creating snapshot, not updating", "fatal")
+		sendnotify(notify.NewEvent("failed", "Failed creating snapshot"))
+		return
+	}
+	undo := "To undo, run: " + defines.BEBIN + " create -e " + snap +
+		" <name> && " + defines.BEBIN + " activate <name> and reboot"
+
+	// From here on pkg works on the real package database
+	pkg.PrepareLivePkgConfig()
+
+	locked, err := pkg.LockHeld(details.Held)
+	if err != nil {
+		ws.SendMsg(err.Error(), "fatal")
+	} else {
+		err = upgradelive(details, info.Essential)
+	}
+	pkg.UnlockHeld(locked)
+	pkg.DestroyMdDev()
+	if err != nil {
+		logger.LogToFile(undo)
+		ws.SendMsg(undo)
+		sendnotify(notify.NewEvent("failed", err.Error()))
+		return
+	}
+
+	if err := hooks.Run(hooks.PostLive, env); err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(undo)
+		ws.SendMsg(err.Error(), "fatal")
+		sendnotify(notify.NewEvent("failed", err.Error()))
+		return
+	}
+
+	ev := notify.NewEvent("completed", "Live update completed")
+	ev.BEName = info.BEName
+	sendnotify(ev)
+
+	logger.LogToFile("Live update finished, snapshot: " + snap)
+	ws.SendMsg("Success! Update applied, no reboot required.", "shutdown")
+}
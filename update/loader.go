@@ -0,0 +1,261 @@
+package update
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/disks"
+	"github.com/trueos/sysup/efiboot"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/ws"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Get the SHA256 of a file, only reading the first size bytes if size is set
+func hashfile(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if size > 0 {
+		r = io.LimitReader(f, size)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Fill in what updating a freebsd-boot partition would do
+func plangpt(
+	d *defines.BootPart, disk disks.Disk, part disks.Partition,
+	stagedir string,
+) {
+	staged := stagedir + "/boot/gptzfsboot"
+	dev := part.Dev()
+
+	st, err := os.Stat(staged)
+	if err != nil {
+		d.Error = "Unable to read " + staged
+		return
+	}
+	hash, err := hashfile(staged, 0)
+	if err != nil {
+		d.Error = "Unable to read " + staged
+		return
+	}
+	d.Staged = &defines.LoaderFile{Path: staged, SHA256: hash}
+
+	// The partition is bigger than the boot code, only compare what would
+	// be written
+	d.Current = &defines.LoaderFile{Path: dev}
+	if hash, err := hashfile(dev, st.Size()); err == nil {
+		d.Current.SHA256 = hash
+	}
+	d.Action = "gpart bootcode -b " + stagedir + "/boot/pmbr -p " + staged +
+		" -i " + strconv.Itoa(part.Index) + " " + disk.Name
+}
+
+// Work out what updating a freebsd-boot partition would do, doing it if
+// apply is set
+func rungpt(
+	disk disks.Disk, part disks.Partition, stagedir string, apply bool,
+) defines.BootPart {
+	bp := defines.BootPart{
+		Partition: part.Name,
+		Index:     part.Index,
+		Type:      part.Type,
+		Action:    "none",
+	}
+	plangpt(&bp, disk, part, stagedir)
+	bp.UpToDate = bp.Current != nil && bp.Staged != nil &&
+		bp.Current.SHA256 != "" && bp.Current.SHA256 == bp.Staged.SHA256
+
+	if apply && bp.Error == "" {
+		logger.LogToFile("Updating GPT bootloader on: " + part.Name)
+		ws.SendMsg("Updating GPT bootloader on: " + part.Name)
+		if err := updategpt(disk, part, stagedir); err != nil {
+			bp.Error = err.Error()
+		}
+	}
+	setresult(&bp, apply)
+	return bp
+}
+
+// Mark how updating a boot partition went
+func setresult(bp *defines.BootPart, apply bool) {
+	if !apply {
+		return
+	}
+	bp.Result = "updated"
+	if bp.Error != "" {
+		bp.Result = "failed"
+		logger.LogToFile(
+			"Failed updating bootloader on " + bp.Partition + ": " + bp.Error,
+		)
+	}
+}
+
+// Sum up how the update of every boot partition went
+func loaderstatus(report defines.LoaderReport) string {
+	var updated, failed int
+	for _, d := range report.Disks {
+		if d.Error != "" {
+			failed++
+		}
+		for _, p := range d.Partitions {
+			switch p.Result {
+			case "updated", "uptodate":
+				updated++
+			case "skipped":
+			default:
+				failed++
+			}
+		}
+	}
+	switch {
+	case failed == 0 && updated > 0:
+		return "ok"
+	case updated > 0:
+		return "partial"
+	default:
+		return "failed"
+	}
+}
+
+// Describe what went wrong updating the boot loader
+func loaderproblems(report defines.LoaderReport) string {
+	problems := []string{"Boot loader update " + report.Status}
+	if report.Error != "" {
+		problems = append(problems, report.Error)
+	}
+	for _, d := range report.Disks {
+		if d.Error != "" {
+			problems = append(problems, d.Error)
+		}
+		for _, p := range d.Partitions {
+			if p.Result != "failed" {
+				continue
+			}
+			name := p.Partition
+			if p.Target != "" {
+				name += " " + p.Target
+			}
+			problems = append(problems, name+": "+p.Error)
+		}
+	}
+	return strings.Join(problems, "\n")
+}
+
+// Go over every boot partition on every disk in the pool, working out what
+// updating it would do and doing it if apply is set. BootNext is only set
+// if bootnext is, since it only means something when a reboot follows.
+func runloader(
+	stagedir string, apply bool, bootnext bool,
+) defines.LoaderReport {
+	report := defines.LoaderReport{Pool: getzfspool()}
+	disklist, err := getzpooldisks()
+	if err != nil {
+		report.Error = err.Error()
+		if apply {
+			report.Status = "failed"
+		}
+		return report
+	}
+
+	// Only touch the firmware boot entries if asked to
+	var mgr efiboot.Manager
+	if defines.EFIBoot != nil {
+		mgr = bootmanager(apply)
+	}
+
+	for _, disk := range disklist {
+		d := defines.BootDisk{Disk: disk.Name, Scheme: disk.Scheme}
+		parts := disk.BootPartitions()
+		if len(parts) == 0 {
+			d.Error = "Unable to locate efi or freebsd-boot partition on: " +
+				disk.Name
+		}
+		for _, part := range parts {
+			if part.Type == "efi" {
+				d.Partitions = append(
+					d.Partitions, runefi(part, stagedir, apply, mgr)...,
+				)
+			} else {
+				d.Partitions = append(
+					d.Partitions, rungpt(disk, part, stagedir, apply),
+				)
+			}
+		}
+		report.Disks = append(report.Disks, d)
+	}
+	if mgr != nil && defines.EFIBoot.BootNext && bootnext {
+		setbootnext(mgr, &report, apply)
+	}
+	if apply {
+		report.Status = loaderstatus(report)
+	}
+	return report
+}
+
+// Report what updating the boot loader would do
+func DoLoaderInfo() {
+	logger.LogToFile("Checking bootloader\n-------------------")
+	report := runloader("", false, true)
+	if report.Error != "" {
+		logger.LogToFile(report.Error)
+		ws.SendMsg(report.Error, "fatal")
+		return
+	}
+
+	type JSONReply struct {
+		Method string               `json:"method"`
+		Report defines.LoaderReport `json:"report"`
+	}
+	msg, err := json.Marshal(&JSONReply{
+		Method: "bootloaderinfo",
+		Report: report,
+	})
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Update the boot loader and report how it went on every partition
+func DoUpdateLoader() {
+	report := UpdateLoader("", true)
+
+	type JSONReply struct {
+		Method string               `json:"method"`
+		Info   string               `json:"info"`
+		Report defines.LoaderReport `json:"report"`
+	}
+	msg, err := json.Marshal(&JSONReply{
+		Method: "updatebootloader",
+		Info:   "Finished bootloader process",
+		Report: report,
+	})
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,254 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/trains"
+	"github.com/trueos/sysup/utils"
+	"github.com/trueos/sysup/ws"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Get the packages installed under a root directory, as name -> version
+func installedpkgs(root string) (map[string]string, error) {
+	out, err := exec.Command(
+		defines.PKGBIN, "-o", "PKG_DBDIR="+filepath.Join(root, "/var/db/pkg"),
+		"query", "-a", "%n %v",
+	).CombinedOutput()
+	if err != nil {
+		return nil, errors.New(
+			"Failed reading packages in " + root + ": " + string(out),
+		)
+	}
+
+	pkgs := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			pkgs[fields[0]] = fields[1]
+		}
+	}
+	return pkgs, nil
+}
+
+// Work out how the installed packages changed from old to new
+func diffpkgs(old map[string]string, new map[string]string) *defines.PkgDiff {
+	diff := &defines.PkgDiff{}
+	for name, version := range new {
+		oldversion, ok := old[name]
+		switch {
+		case !ok:
+			diff.Added = append(
+				diff.Added, defines.NewPkg{Name: name, Version: version},
+			)
+		case oldversion != version:
+			diff.Changed = append(diff.Changed, defines.UpPkg{
+				Name: name, OldVersion: oldversion, NewVersion: version,
+			})
+		}
+	}
+	for name, version := range old {
+		if _, ok := new[name]; !ok {
+			diff.Removed = append(
+				diff.Removed, defines.DelPkg{Name: name, Version: version},
+			)
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool {
+		return diff.Added[i].Name < diff.Added[j].Name
+	})
+	sort.Slice(diff.Removed, func(i, j int) bool {
+		return diff.Removed[i].Name < diff.Removed[j].Name
+	})
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Name < diff.Changed[j].Name
+	})
+	return diff
+}
+
+func readmanifest(root string) (*defines.BEManifest, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(root, defines.BEManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var m defines.BEManifest
+	if err := json.Unmarshal(dat, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func writemanifest(root string, m *defines.BEManifest) error {
+	dat, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(
+		filepath.Join(root, defines.BEManifestFile), dat, 0644,
+	)
+}
+
+// Start the manifest in the new BE during stage 1
+func startmanifest(info defines.StageInfo) {
+	m := &defines.BEManifest{
+		BEName:       info.BEName,
+		Parent:       info.OldBEName,
+		Train:        trains.CurrentTrain(),
+		SysUpVersion: defines.Version,
+		Details:      info.Details,
+		StagedAt:     info.StagedAt,
+	}
+	parent, err := installedpkgs("/")
+	if err != nil {
+		logger.LogToFile(err.Error())
+	}
+	m.ParentPkgs = parent
+
+	if err := writemanifest(defines.STAGEDIR, m); err != nil {
+		logger.LogToFile("Failed writing BE manifest: " + err.Error())
+	}
+}
+
+// Finish the manifest of the BE we are running once stage 2 is done
+func completemanifest() {
+	m, err := readmanifest("/")
+	if err != nil {
+		logger.LogToFile("No BE manifest to complete: " + err.Error())
+		return
+	}
+
+	now := time.Now()
+	m.CompletedAt = &now
+	if installed, err := installedpkgs("/"); err == nil && m.ParentPkgs != nil {
+		m.Diff = diffpkgs(m.ParentPkgs, installed)
+		m.ParentPkgs = nil
+	} else if err != nil {
+		logger.LogToFile(err.Error())
+	}
+
+	if err := writemanifest("/", m); err != nil {
+		logger.LogToFile("Failed writing BE manifest: " + err.Error())
+	}
+}
+
+// Get a BE's root directory, mounting it if needed. The returned func must
+// be called once done with it.
+func mountbe(name string) (string, func(), error) {
+	be, err := getbe(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if be.Current {
+		return "/", func() {}, nil
+	}
+	if be.Mountpoint != "" && be.Mountpoint != "-" {
+		return be.Mountpoint, func() {}, nil
+	}
+
+	dir, err := ioutil.TempDir("", defines.ToolName+"-be")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := runbeadm("mount", name, dir); err != nil {
+		os.Remove(dir)
+		return "", nil, err
+	}
+	return dir, func() {
+		runbeadm("umount", name)
+		os.Remove(dir)
+	}, nil
+}
+
+// Get the manifest of a BE, and the package differences to another BE if
+// one is given
+func getbemanifest(
+	name string, other string,
+) (*defines.BEManifest, *defines.PkgDiff, error) {
+	root, cleanup, err := mountbe(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+
+	m, err := readmanifest(root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, errors.New(
+			"Invalid manifest in " + name + ": " + err.Error(),
+		)
+	}
+	if other == "" {
+		if m == nil {
+			return nil, nil, errors.New("No update manifest in " + name)
+		}
+		return m, nil, nil
+	}
+
+	// Compare what is really installed, not every BE has a manifest
+	pkgs, err := installedpkgs(root)
+	if err != nil {
+		return m, nil, err
+	}
+	oroot, ocleanup, err := mountbe(other)
+	if err != nil {
+		return m, nil, err
+	}
+	defer ocleanup()
+	opkgs, err := installedpkgs(oroot)
+	if err != nil {
+		return m, nil, err
+	}
+	return m, diffpkgs(opkgs, pkgs), nil
+}
+
+func DoBEInfo(message []byte) {
+	var s struct {
+		defines.Envelope
+		defines.SendReq
+	}
+	if err := json.Unmarshal(message, &s); err != nil {
+		log.Fatal(err)
+	}
+
+	m, diff, err := getbemanifest(s.Bename, s.DiffBE)
+	if err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+
+	type JSONReply struct {
+		Method   string              `json:"method"`
+		BEName   string              `json:"bename"`
+		Manifest *defines.BEManifest `json:"manifest"`
+		DiffBE   string              `json:"diffbe,omitempty"`
+		Diff     *defines.PkgDiff    `json:"diff,omitempty"`
+	}
+
+	data := &JSONReply{
+		Method:   "beinfo",
+		BEName:   s.Bename,
+		Manifest: m,
+		DiffBE:   s.DiffBE,
+		Diff:     diff,
+	}
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,148 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/utils"
+	"github.com/trueos/sysup/ws"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Save the staged update so we can report it until it is booted
+func writepending(info defines.StageInfo) {
+	dat, err := json.Marshal(info)
+	if err != nil {
+		logger.LogToFile("Failed encoding pending update: " + err.Error())
+		return
+	}
+	os.MkdirAll(filepath.Dir(defines.PendingState), 0755)
+	if err := utils.WriteFileAtomic(defines.PendingState, dat, 0644); err != nil {
+		logger.LogToFile("Failed saving pending update: " + err.Error())
+	}
+}
+
+// Get the update waiting on a reboot, if any. Records for updates which have
+// since been booted or whose boot-environment is gone are cleaned up.
+func GetPending() *defines.PendingReboot {
+	dat, err := ioutil.ReadFile(defines.PendingState)
+	if err != nil {
+		return nil
+	}
+	var pending defines.PendingReboot
+	if err := json.Unmarshal(dat, &pending.StageInfo); err != nil {
+		logger.LogToFile("Removing invalid pending update: " + err.Error())
+		os.Remove(defines.PendingState)
+		return nil
+	}
+
+	// Already running the update
+	if pending.BEName == strings.TrimSpace(getcurrentbe()) {
+		os.Remove(defines.PendingState)
+		return nil
+	}
+
+	bes, err := listbes()
+	if err != nil {
+		logger.LogToFile(err.Error())
+		return &pending
+	}
+	be, ok := findbe(bes, pending.BEName)
+	if !ok {
+		logger.LogToFile("Staged boot-environment is gone: " + pending.BEName)
+		os.Remove(defines.PendingState)
+		return nil
+	}
+	pending.Active = strings.Contains(be.active, "R")
+	pending.RebootAt = scheduledreboot()
+	return &pending
+}
+
+// Reply with any update waiting on a reboot
+func DoStatus() {
+	type JSONReply struct {
+		Method  string                 `json:"method"`
+		Pending *defines.PendingReboot `json:"pending"`
+	}
+
+	data := &JSONReply{
+		Method:  "status",
+		Pending: GetPending(),
+	}
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Throw away the staged update and keep booting the current BE
+func cancelstaged() (string, error) {
+	pending := GetPending()
+	if pending == nil {
+		return "", errors.New("No staged update to cancel")
+	}
+
+	// No point rebooting into the BE we are running
+	cancelreboot()
+
+	current := strings.TrimSpace(getcurrentbe())
+	out, err := exec.Command(defines.BEBIN, "activate", current).CombinedOutput()
+	if err != nil {
+		return "", errors.New(
+			"Failed activating " + current + ": " + string(out),
+		)
+	}
+	out, err = exec.Command(
+		defines.BEBIN, "destroy", "-F", pending.BEName,
+	).CombinedOutput()
+	if err != nil {
+		return "", errors.New(
+			"Failed destroying " + pending.BEName + ": " + string(out),
+		)
+	}
+	os.Remove(defines.PendingState)
+
+	logger.LogToFile("Cancelled staged update: " + pending.BEName)
+	return pending.BEName, nil
+}
+
+func DoCancelStaged() {
+	bename, err := cancelstaged()
+	if err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+
+	// Send back confirmation
+	type JSONReply struct {
+		Method string `json:"method"`
+		BEName string `json:"bename"`
+	}
+
+	data := &JSONReply{
+		Method: "cancelstaged",
+		BEName: bename,
+	}
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,151 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/ws"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Boot-environment sysup created which the retention policy applies to
+type prunable struct {
+	name    string
+	created time.Time
+}
+
+// Work out which boot-environments the retention policy would destroy.
+// BEs sysup didn't create, pinned BEs, the running BE, the BE used on the
+// next boot and any staged update are never touched.
+func planprune(
+	policy defines.RetentionConfig, now time.Time,
+) ([]string, []string, error) {
+	bes, err := listbes()
+	if err != nil {
+		return nil, nil, err
+	}
+	props, err := getbeprops()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	skip := map[string]bool{strings.TrimSpace(getcurrentbe()): true}
+	if pending := GetPending(); pending != nil {
+		skip[pending.BEName] = true
+	}
+
+	var candidates []prunable
+	for _, be := range bes {
+		p := props[be.name]
+		if skip[be.name] || strings.ContainsAny(be.active, "NR") {
+			continue
+		}
+		if p[proppinned] == "yes" {
+			continue
+		}
+		created, err := strconv.ParseInt(p[propcreated], 10, 64)
+		if err != nil {
+			continue
+		}
+		candidates = append(
+			candidates, prunable{name: be.name, created: time.Unix(created, 0)},
+		)
+	}
+
+	// Newest first
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].created.After(candidates[j].created)
+	})
+
+	var destroy, keep []string
+	cutoff := now.AddDate(0, 0, -policy.KeepDays)
+	for i, c := range candidates {
+		if (policy.Keep > 0 && i < policy.Keep) ||
+			(policy.KeepDays > 0 && c.created.After(cutoff)) {
+			keep = append(keep, c.name)
+			continue
+		}
+		destroy = append(destroy, c.name)
+	}
+	return destroy, keep, nil
+}
+
+// Apply the retention policy, returning the BEs destroyed (or which would be
+// for a dry run) and those kept
+func prunebes(dryrun bool) ([]string, []string, error) {
+	if defines.BERetention == nil {
+		return nil, nil, errors.New(
+			"No beretention policy configured in " + defines.ConfigJson,
+		)
+	}
+	destroy, keep, err := planprune(*defines.BERetention, time.Now())
+	if err != nil || dryrun {
+		return destroy, keep, err
+	}
+
+	var destroyed, failed []string
+	for _, be := range destroy {
+		logger.LogToFile("Pruning boot-environment: " + be)
+		out, err := exec.Command(defines.BEBIN, "destroy", "-F", be).
+			CombinedOutput()
+		if err != nil {
+			logger.LogToFile("Failed destroying " + be + ": " + string(out))
+			failed = append(failed, be)
+			continue
+		}
+		destroyed = append(destroyed, be)
+	}
+	if len(failed) > 0 {
+		return destroyed, keep, errors.New(
+			"Failed destroying: " + strings.Join(failed, " "),
+		)
+	}
+	return destroyed, keep, nil
+}
+
+func DoPruneBEs(message []byte) {
+	var s struct {
+		defines.Envelope
+		defines.SendReq
+	}
+	if err := json.Unmarshal(message, &s); err != nil {
+		log.Fatal(err)
+	}
+
+	destroyed, keep, err := prunebes(s.DryRun)
+	if err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+
+	type JSONReply struct {
+		Method    string   `json:"method"`
+		DryRun    bool     `json:"dryrun"`
+		Destroyed []string `json:"destroyed"`
+		Kept      []string `json:"kept"`
+	}
+
+	data := &JSONReply{
+		Method:    "prunebes",
+		DryRun:    s.DryRun,
+		Destroyed: destroyed,
+		Kept:      keep,
+	}
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,229 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/ws"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reboots the system
+type Rebooter interface {
+	Reboot() error
+}
+
+// Rebooter which really reboots
+type SystemRebooter struct{}
+
+func (SystemRebooter) Reboot() error {
+	return exec.Command("reboot").Run()
+}
+
+// Used for every reboot sysup does, replaceable so tests can fake it
+var DefaultRebooter Rebooter = SystemRebooter{}
+
+// Reboot scheduled after staging an update
+var rebootlock sync.Mutex
+var rebootat time.Time
+var rebootcancel chan bool
+
+// Countdown event broadcast to clients while waiting to reboot
+type RebootEvent struct {
+	Method    string    `json:"method"`
+	At        time.Time `json:"at"`
+	Remaining int       `json:"remaining"`
+}
+
+// Get when to reboot for a -reboot value
+func parsereboot(mode string, now time.Time) (time.Time, error) {
+	switch {
+	case mode == "now":
+		return now, nil
+	case strings.HasPrefix(mode, "at="):
+		t, err := time.Parse("15:04", strings.TrimPrefix(mode, "at="))
+		if err != nil {
+			return time.Time{}, errors.New("Invalid reboot time: " + mode)
+		}
+		at := time.Date(
+			now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0,
+			now.Location(),
+		)
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, nil
+	case mode == "window":
+		if defines.Schedule == nil {
+			return time.Time{}, errors.New(
+				"No maintenance window configured in " + defines.ConfigJson,
+			)
+		}
+		w := defines.Schedule.Window
+		if w.Contains(now) {
+			return now, nil
+		}
+		at := w.Next(now)
+		if at.IsZero() {
+			return at, errors.New("Maintenance window never opens")
+		}
+		return at, nil
+	}
+	return time.Time{}, errors.New(
+		"Invalid reboot option: " + mode + " (use now, at=HH:MM or window)",
+	)
+}
+
+// Make sure a -reboot value is usable before we start updating
+func checkreboot(mode string) error {
+	if mode == "" {
+		return nil
+	}
+	_, err := parsereboot(mode, time.Now())
+	return err
+}
+
+// Connection of the client which asked for the reboot
+type msgwriter interface {
+	WriteMessage(messagetype int, data []byte) error
+}
+
+// Reboot at the given time, counting down to the client which asked for it
+func schedulereboot(at time.Time) {
+	// Later requests take over defines.WSServer, so hold on to this client
+	var conn msgwriter
+	if defines.WSServer != nil {
+		conn = defines.WSServer
+	}
+	startcountdown(at, conn)
+}
+
+func startcountdown(at time.Time, conn msgwriter) {
+	rebootlock.Lock()
+	if rebootcancel != nil {
+		close(rebootcancel)
+	}
+	cancel := make(chan bool)
+	rebootcancel = cancel
+	rebootat = at
+	rebootlock.Unlock()
+
+	logger.LogToFile("Reboot scheduled for: " + at.Format(time.RFC1123))
+	go countdown(at, cancel, conn)
+}
+
+func countdown(at time.Time, cancel chan bool, conn msgwriter) {
+	for {
+		remaining := time.Until(at)
+		if remaining < 0 {
+			remaining = 0
+		}
+		sendto(conn, &RebootEvent{
+			Method:    "reboot",
+			At:        at,
+			Remaining: int(remaining.Seconds()),
+		})
+		if remaining == 0 {
+			break
+		}
+
+		// Count down by the minute, then faster for the last one
+		step := time.Minute
+		if remaining <= time.Minute {
+			step = 10 * time.Second
+		}
+		if remaining < step {
+			step = remaining
+		}
+		select {
+		case <-time.After(step):
+		case <-cancel:
+			sendto(conn, &struct {
+				Method string `json:"method"`
+			}{Method: "rebootcancelled"})
+			return
+		}
+	}
+
+	// Let the client go before we lose the connection
+	logger.LogToFile("Rebooting to finish the update")
+	sendto(conn, &ws.JSONReply{
+		Method: "shutdown",
+		Info:   "Rebooting to finish the update",
+	})
+	if err := DefaultRebooter.Reboot(); err != nil {
+		logger.LogToFile("Failed rebooting: " + err.Error())
+	}
+}
+
+// Send a message to the client waiting on the reboot, if it is still there
+func sendto(conn msgwriter, data interface{}) {
+	msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if conn == nil {
+		log.Println(string(msg))
+		return
+	}
+
+	// Don't write over the top of a client request in progress
+	defines.OpLock.Lock()
+	defer defines.OpLock.Unlock()
+
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		log.Println("reboot:", err)
+	}
+}
+
+// Get when the scheduled reboot will happen, or nil if there isn't one
+func scheduledreboot() *time.Time {
+	rebootlock.Lock()
+	defer rebootlock.Unlock()
+	if rebootcancel == nil {
+		return nil
+	}
+	at := rebootat
+	return &at
+}
+
+// Stop a scheduled reboot
+func cancelreboot() error {
+	rebootlock.Lock()
+	defer rebootlock.Unlock()
+	if rebootcancel == nil {
+		return errors.New("No reboot is scheduled")
+	}
+	close(rebootcancel)
+	rebootcancel = nil
+	logger.LogToFile("Scheduled reboot cancelled")
+	return nil
+}
+
+func DoCancelReboot() {
+	if err := cancelreboot(); err != nil {
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+
+	// Send back confirmation
+	type JSONReply struct {
+		Method string `json:"method"`
+	}
+
+	msg, err := json.Marshal(&JSONReply{Method: "rebootcancelled"})
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, msg,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/internal/testlog"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	testlog.Run(m)
+}
+
+// Rebooter which only counts reboots
+type fakerebooter struct {
+	reboots chan bool
+	err     error
+}
+
+func (r *fakerebooter) Reboot() error {
+	r.reboots <- true
+	return r.err
+}
+
+// Replace the rebooter with a fake, returning it and a func putting the
+// real one back
+func fakereboot(err error) (*fakerebooter, func()) {
+	r := &fakerebooter{reboots: make(chan bool, 1), err: err}
+	old := DefaultRebooter
+	DefaultRebooter = r
+	return r, func() { DefaultRebooter = old }
+}
+
+// Client connection collecting the methods sent to it
+type fakeconn struct {
+	methods chan string
+}
+
+func newfakeconn() *fakeconn {
+	return &fakeconn{methods: make(chan string, 10)}
+}
+
+func (c *fakeconn) WriteMessage(messagetype int, data []byte) error {
+	var env defines.Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return err
+	}
+	c.methods <- env.Method
+	return nil
+}
+
+// Wait for the next method sent to the client
+func (c *fakeconn) next(t *testing.T) string {
+	select {
+	case method := <-c.methods:
+		return method
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing sent to the client")
+	}
+	return ""
+}
+
+func TestCountdownReboots(t *testing.T) {
+	r, restore := fakereboot(nil)
+	defer restore()
+	conn := newfakeconn()
+
+	startcountdown(time.Now(), conn)
+	if m := conn.next(t); m != "reboot" {
+		t.Fatalf("got %q, want the countdown", m)
+	}
+	if m := conn.next(t); m != "shutdown" {
+		t.Fatalf("got %q, want shutdown", m)
+	}
+	select {
+	case <-r.reboots:
+	case <-time.After(5 * time.Second):
+		t.Fatal("never rebooted")
+	}
+}
+
+func TestCountdownRebootFails(t *testing.T) {
+	r, restore := fakereboot(errors.New("reboot failed"))
+	defer restore()
+
+	// Nobody is listening, the reboot must still happen
+	startcountdown(time.Now(), nil)
+	select {
+	case <-r.reboots:
+	case <-time.After(5 * time.Second):
+		t.Fatal("never rebooted")
+	}
+}
+
+func TestCancelRebootTellsWaitingClient(t *testing.T) {
+	r, restore := fakereboot(nil)
+	defer restore()
+	conn := newfakeconn()
+
+	at := time.Now().Add(time.Hour)
+	startcountdown(at, conn)
+	if m := conn.next(t); m != "reboot" {
+		t.Fatalf("got %q, want the countdown", m)
+	}
+	if got := scheduledreboot(); got == nil || !got.Equal(at) {
+		t.Fatalf("scheduled reboot = %v, want %v", got, at)
+	}
+
+	// Cancelled from some other client connection
+	if err := cancelreboot(); err != nil {
+		t.Fatal(err)
+	}
+	if m := conn.next(t); m != "rebootcancelled" {
+		t.Fatalf("got %q, want rebootcancelled", m)
+	}
+	if scheduledreboot() != nil {
+		t.Fatal("reboot still scheduled after cancelling")
+	}
+	if err := cancelreboot(); err == nil {
+		t.Fatal("cancelled a reboot which isn't scheduled")
+	}
+
+	select {
+	case <-r.reboots:
+		t.Fatal("rebooted after cancelling")
+	default:
+	}
+}
+
+func TestParseReboot(t *testing.T) {
+	now := time.Date(2026, time.January, 5, 12, 30, 0, 0, time.UTC)
+	defines.Schedule = &defines.ScheduleConfig{
+		Window: defines.MaintWindow{Start: 2, End: 4},
+	}
+	defer func() { defines.Schedule = nil }()
+
+	tests := []struct {
+		mode string
+		want time.Time
+		err  bool
+	}{
+		{"now", now, false},
+		{"at=13:00", now.Add(30 * time.Minute), false},
+		{"at=12:00", now.Add(23*time.Hour + 30*time.Minute), false},
+		{"window", time.Date(2026, time.January, 6, 2, 0, 0, 0, time.UTC), false},
+		{"at=25:00", time.Time{}, true},
+		{"later", time.Time{}, true},
+	}
+	for _, test := range tests {
+		got, err := parsereboot(test.mode, now)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.mode, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("%s: got %v, want %v", test.mode, got, test.want)
+		}
+	}
+}
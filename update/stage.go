@@ -0,0 +1,126 @@
+package update
+
+import (
+	"encoding/json"
+	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/hooks"
+	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/notify"
+	"github.com/trueos/sysup/utils"
+	"github.com/trueos/sysup/ws"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A stage 1 phase was aborted
+func abortstage(err error) {
+	logger.LogToFile(err.Error())
+	ws.SendMsg(err.Error(), "fatal")
+	sendnotify(notify.NewEvent("failed", err.Error()))
+}
+
+// Save the details of the update into the new BE for stage 2
+func writestagestate(info defines.StageInfo) {
+	dat, err := json.Marshal(info)
+	if err != nil {
+		logger.LogToFile("Failed encoding stage state: " + err.Error())
+		return
+	}
+	err = ioutil.WriteFile(defines.STAGEDIR+defines.StageState, dat, 0644)
+	if err != nil {
+		logger.LogToFile("Failed writing stage state: " + err.Error())
+	}
+}
+
+// Load the details saved by stage 1, falling back to the BE name markers if
+// the update was staged by an older sysup
+func readstagestate() defines.StageInfo {
+	var info defines.StageInfo
+	if dat, err := ioutil.ReadFile(defines.StageState); err == nil {
+		if err := json.Unmarshal(dat, &info); err != nil {
+			logger.LogToFile("Invalid stage state: " + err.Error())
+		}
+	}
+
+	if info.BEName == "" {
+		if dat, err := ioutil.ReadFile("/.updategobename"); err == nil {
+			info.BEName = strings.TrimSpace(string(dat))
+		}
+	}
+	if info.OldBEName == "" {
+		if dat, err := ioutil.ReadFile("/.updategooldbename"); err == nil {
+			info.OldBEName = strings.TrimSpace(string(dat))
+		}
+	}
+	info.FullUpdate = defines.FullUpdateFlag || info.FullUpdate
+	if info.Only == "" {
+		info.Only = defines.OnlyFlag
+	}
+	defines.OnlyFlag = info.Only
+
+	// Update the boot loader how the config said when we staged
+	if info.EFITargets != nil {
+		defines.EFITargets = info.EFITargets
+	}
+	defines.EFIBoot = info.EFIBoot
+	return info
+}
+
+// Leave the update details for sysup -postboot
+func writepostbootstate(info defines.StageInfo) {
+	dat, err := json.Marshal(info)
+	if err != nil {
+		logger.LogToFile("Failed encoding post-boot state: " + err.Error())
+		return
+	}
+	os.MkdirAll(filepath.Dir(defines.PostBootState), 0755)
+	if err := utils.WriteFileAtomic(defines.PostBootState, dat, 0644); err != nil {
+		logger.LogToFile("Failed writing post-boot state: " + err.Error())
+	}
+}
+
+// Run once the system has fully booted into a freshly updated BE
+func PostBoot() {
+	// No WS server to talk to
+	defines.DisableWSMsg = true
+
+	dat, err := ioutil.ReadFile(defines.PostBootState)
+	if err != nil {
+		return
+	}
+	os.Remove(defines.PostBootState)
+
+	var info defines.StageInfo
+	if err := json.Unmarshal(dat, &info); err != nil {
+		logger.LogToFile("Invalid post-boot state: " + err.Error())
+		return
+	}
+
+	// Stage 2 queued a notification, leave a note in the log too
+	if info.Loader != nil && info.Loader.Status != "ok" {
+		logger.LogToFile(
+			"Boot loader update during stage 2: " + info.Loader.Status,
+		)
+	}
+
+	if err := hooks.Run(hooks.PostBoot, hooks.StageEnv(info)); err != nil {
+		logger.LogToFile(err.Error())
+		notify.Deliver(notify.NewEvent("failed", err.Error()))
+	}
+
+	// Clean out old boot-environments now the new one is known good
+	if defines.BERetention != nil {
+		if destroyed, _, err := prunebes(false); err != nil {
+			logger.LogToFile("Failed pruning boot-environments: " + err.Error())
+		} else if len(destroyed) > 0 {
+			logger.LogToFile(
+				"Pruned boot-environments: " + strings.Join(destroyed, " "),
+			)
+		}
+	}
+
+	// The network is up now, send what stage 2 queued
+	notify.SendPending()
+}
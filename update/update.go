@@ -7,17 +7,22 @@ import (
 	"errors"
 	"fmt"
 	"github.com/trueos/sysup/defines"
+	"github.com/trueos/sysup/disks"
+	"github.com/trueos/sysup/hooks"
 	"github.com/trueos/sysup/logger"
+	"github.com/trueos/sysup/notify"
 	"github.com/trueos/sysup/pkg"
+	"github.com/trueos/sysup/trains"
 	"github.com/trueos/sysup/ws"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"time"
 )
 
 func DoUpdate(message []byte) {
@@ -37,6 +42,9 @@ func DoUpdate(message []byte) {
 	defines.UpdateFileFlag = s.Updatefile
 	defines.UpdateKeyFlag = s.Updatekey
 	defines.FetchOnlyFlag = s.Fetchonly
+	defines.OnlyFlag = s.Only
+	defines.LiveFlag = s.Live
+	defines.RebootFlag = s.Reboot
 	//log.Println("benameflag: " + benameflag)
 	//log.Println("updatefile: " + updatefileflag)
 
@@ -52,6 +60,45 @@ func DoUpdate(message []byte) {
 	// Start a fresh log file
 	logger.RotateLog()
 
+	if err := pkg.CheckOnly(); err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+	if err := checkreboot(defines.RebootFlag); err != nil {
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+	if defines.LiveFlag && defines.RebootFlag != "" {
+		ws.SendMsg("-reboot can not be used with -live", "fatal")
+		return
+	}
+
+	// Let the admin hooks veto the update before we start
+	if err := hooks.Run(hooks.PreCheck, nil); err != nil {
+		logger.LogToFile(err.Error())
+		ws.SendMsg(err.Error(), "fatal")
+		return
+	}
+
+	// Make sure we aren't updating from a deprecated train
+	if err := trains.CheckTrain(); err != nil {
+		return
+	}
+
+	// Pick the new boot-environment name now, so a bad name fails early.
+	// Live and fetch only updates never create one
+	var bename string
+	if !defines.LiveFlag && !defines.FetchOnlyFlag {
+		var err error
+		bename, err = getbename()
+		if err != nil {
+			logger.LogToFile(err.Error())
+			ws.SendMsg(err.Error(), "fatal")
+			return
+		}
+	}
+
 	// Setup the pkg config directory
 	logger.LogToFile("Setting up pkg database")
 	pkg.PreparePkgConfig("")
@@ -77,6 +124,26 @@ func DoUpdate(message []byte) {
 		defines.FullUpdateFlag = true
 	}
 
+	// Live updates can't touch anything which needs a reboot
+	if defines.LiveFlag && (details.Reboot || defines.FullUpdateFlag) {
+		msg := "Live update not possible, a reboot is required"
+		if base := pkg.BasePkgs(details); len(base) > 0 {
+			msg += " for: " + strings.Join(base, " ")
+		}
+		ws.SendMsg(msg, "fatal")
+		return
+	}
+
+	// A kernel or ABI change has to update everything to be safe
+	if defines.OnlyFlag != "" && (details.KernelUp || defines.FullUpdateFlag) {
+		ws.SendMsg(
+			"Update of "+defines.OnlyFlag+" requires a kernel or ABI change,"+
+				" run a full update instead",
+			"fatal",
+		)
+		return
+	}
+
 	// Check if we are moving from pre-flavor pkg base to flavors
 	checkFlavorSwitch()
 
@@ -119,8 +186,13 @@ func DoUpdate(message []byte) {
 	}
 	defines.KernelPkg = details.KernelPkg
 
+	if defines.LiveFlag {
+		startlive(details)
+		return
+	}
+
 	// Start the upgrade with bool passed if doing kernel update
-	startUpgrade(kernelupdate)
+	startUpgrade(kernelupdate, details, bename)
 }
 
 // This is called after a sysup boot-strap has taken place
@@ -150,6 +222,18 @@ func dopassthroughupdate() error {
 	if defines.UpdateKeyFlag != "" {
 		ukeyflag = "-updatekey=" + defines.UpdateKeyFlag
 	}
+	var onlyflag string
+	if defines.OnlyFlag != "" {
+		onlyflag = "-only=" + defines.OnlyFlag
+	}
+	var liveflag string
+	if defines.LiveFlag {
+		liveflag = "-live"
+	}
+	var rebootflag string
+	if defines.RebootFlag != "" {
+		rebootflag = "-reboot=" + defines.RebootFlag
+	}
 
 	// Start the newly updated sysup binary, passing along our previous flags
 	//upflags := fuflag + " " + upflag + " " + beflag + " " + ukeyflag
@@ -170,6 +254,15 @@ func dopassthroughupdate() error {
 	if ukeyflag != "" {
 		cmd.Args = append(cmd.Args, ukeyflag)
 	}
+	if onlyflag != "" {
+		cmd.Args = append(cmd.Args, onlyflag)
+	}
+	if liveflag != "" {
+		cmd.Args = append(cmd.Args, liveflag)
+	}
+	if rebootflag != "" {
+		cmd.Args = append(cmd.Args, rebootflag)
+	}
 
 	bsMsg := "Running bootstrap with flags: " + strings.Join(cmd.Args, " ")
 	logger.LogToFile(bsMsg)
@@ -203,6 +296,7 @@ func dopassthroughupdate() error {
 			ws.SendMsg(errarr[i])
 		}
 		ws.SendMsg("Failed sysup bootstrap!", "fatal")
+		sendnotify(notify.NewEvent("failed", "Failed sysup bootstrap"))
 		return err
 	}
 
@@ -734,6 +828,11 @@ func updatercscript() {
 		upflag = "-updatefile " + defines.UpdateFileFlag
 	}
 
+	var onlyflag string
+	if defines.OnlyFlag != "" {
+		onlyflag = "-only " + defines.OnlyFlag
+	}
+
 	selfbin, _ := os.Executable()
 	ugobin := "/." + defines.ToolName
 	cpCmd = exec.Command("install", "-m", "755", selfbin, defines.STAGEDIR+ugobin)
@@ -748,14 +847,14 @@ func updatercscript() {
 	fdata := `#!/bin/sh
 PATH="/sbin:/bin:/usr/sbin:/usr/bin:/usr/local/sbin:/usr/local/bin"
 export PATH
-` + ugobin + ` -stage2 ` + fuflag + ` ` + upflag + ` ` + cacheflag + ` && sh /etc/rc`
+` + ugobin + ` -stage2 ` + fuflag + ` ` + upflag + ` ` + cacheflag + ` ` + onlyflag + ` && sh /etc/rc && { ` + ugobin + ` -postboot & }`
 	ioutil.WriteFile(defines.STAGEDIR+"/etc/rc", []byte(fdata), 0755)
 
 	ws.SendMsg("Finished stage package update")
 	logger.LogToFile("FinishedPackageUpdate\n-----------------------")
 }
 
-func updateincremental(force bool) error {
+func updateincremental(force bool, essential []string) error {
 	var stdoutBuf, stderrBuf bytes.Buffer
 	var errStdout, errStderr error
 
@@ -804,6 +903,8 @@ func updateincremental(force bool) error {
 	if force {
 		cmd.Args = append(cmd.Args, "-f")
 	}
+	// Only updating some packages?
+	cmd.Args = append(cmd.Args, pkg.OnlyPkgs()...)
 	logger.LogToFile("Starting upgrade with: " + strings.Join(cmd.Args, " "))
 	if err := cmd.Start(); err != nil {
 		pkg.DestroyMdDev()
@@ -861,20 +962,16 @@ func updateincremental(force bool) error {
 	logger.LogToFile("FinishedPackageUpdate\n-----------------------")
 
 	// Mark essential pkgs
-	critpkg := []string{"ports-mgmt/pkg", "os/userland", "os/kernel", "sysutils/openzfs"}
-	for i := range critpkg {
-		pkgcmd = exec.Command(
-			defines.PKGBIN, "-C", defines.PkgConf,
-			"set", "-y", "-A", "00", critpkg[i],
-		)
-		fullout, _ = pkgcmd.CombinedOutput()
-		ws.SendMsg(string(fullout))
-		logger.LogToFile(string(fullout))
-	}
+	markessential(essential)
 
 	// Check if we need to restore a migrated /etc
 	restoreSubEtc()
 
+	// Leave the rest of the system alone on a limited update
+	if defines.OnlyFlag != "" {
+		return nil
+	}
+
 	// Cleanup orphans
 	pkgcmd = exec.Command(
 		defines.PKGBIN, "-C", defines.PkgConf,
@@ -969,12 +1066,35 @@ func updatekernel() {
 
 }
 
-func startUpgrade(kernelupdate bool) {
+func startUpgrade(
+	kernelupdate bool, details *defines.UpdateInfo, bename string,
+) {
+	info := defines.StageInfo{
+		BEName:     bename,
+		OldBEName:  strings.TrimSpace(getcurrentbe()),
+		KernelUp:   kernelupdate,
+		FullUpdate: defines.FullUpdateFlag,
+		Details:    details,
+		Essential:  getessential(),
+		Only:       defines.OnlyFlag,
+		StagedAt:   time.Now(),
+		EFITargets: defines.EFITargets,
+		EFIBoot:    defines.EFIBoot,
+	}
+	env := hooks.StageEnv(info)
+
+	if err := hooks.Run(hooks.PreStage1, env); err != nil {
+		abortstage(err)
+		return
+	}
 
 	cleanupbe()
 
 	createnewbe()
 
+	// Mark the BE as ours so the retention policy may prune it later
+	markbe(defines.BESTAGE, info)
+
 	// If we are using standalone update need to nullfs mount the pkgs
 	doupdatefilemnt(defines.STAGEDIR)
 
@@ -986,11 +1106,48 @@ func startUpgrade(kernelupdate bool) {
 	// Cleanup nullfs mount
 	doupdatefileumnt(defines.STAGEDIR)
 
+	// Save what we staged for stage 2
+	writestagestate(info)
+	startmanifest(info)
+
 	// Rename to proper BE name
-	renamebe()
+	err := renamebe(info.BEName)
 
 	// If we are using standalone update, cleanup
 	pkg.DestroyMdDev()
+
+	if err != nil {
+		sendnotify(notify.NewEvent("failed", err.Error()))
+		return
+	}
+
+	if err := hooks.Run(hooks.PostStage1, env); err != nil {
+		// Don't boot into an update the hooks rejected
+		exec.Command(defines.BEBIN, "activate", info.OldBEName).Run()
+		abortstage(err)
+		return
+	}
+
+	ev := notify.NewEvent("staged", "Update staged, reboot to continue")
+	ev.BEName = info.BEName
+	sendnotify(ev)
+
+	// Remember there is an update waiting on a reboot
+	writepending(info)
+
+	if defines.RebootFlag != "" {
+		at, err := parsereboot(defines.RebootFlag, time.Now())
+		if err == nil {
+			ws.SendMsg(
+				"Success! Update staged, rebooting at " +
+					at.Format(time.RFC1123),
+			)
+			schedulereboot(at)
+			return
+		}
+		logger.LogToFile("Not rebooting: " + err.Error())
+	}
+
 	ws.SendMsg(
 		"Success! Reboot your system to continue the update process.",
 		"shutdown",
@@ -1012,7 +1169,7 @@ func prepareStage2() {
 	dat, err := ioutil.ReadFile("/.updategooldbename")
 	if err != nil {
 		copylogexit(err, "Failed reading /.updategooldbename")
-		rebootNow()
+		DefaultRebooter.Reboot()
 	}
 
 	bename := strings.TrimSpace(string(dat))
@@ -1048,7 +1205,7 @@ func prepareStage2() {
 	err = cpCmd.Run()
 	if err != nil {
 		copylogexit(err, "Failed restoring /etc/rc")
-		rebootNow()
+		DefaultRebooter.Reboot()
 	}
 }
 
@@ -1059,23 +1216,70 @@ func StartStage2() {
 
 	prepareStage2()
 
+	info := readstagestate()
+	env := hooks.StageEnv(info)
+	if err := hooks.Run(hooks.PreStage2, env); err != nil {
+		copylogexit(err, err.Error())
+		DefaultRebooter.Reboot()
+		return
+	}
+
 	doupdatefilemnt("")
 
-	if err := updateincremental(defines.FullUpdateFlag); err != nil {
-		rebootNow()
+	// Staged by a sysup without an essential list, use the defaults
+	essential := info.Essential
+	if essential == nil {
+		essential = defines.EssentialPkgs
+	}
+
+	if err := updateincremental(defines.FullUpdateFlag, essential); err != nil {
+		sendnotify(notify.NewEvent("failed", err.Error()))
+		DefaultRebooter.Reboot()
 		return
 	}
 
+	// Held packages were locked while planning, put them back how they were
+	if info.Details != nil {
+		pkg.UnlockHeld(info.Details.Locked)
+	}
+
 	// Cleanup nullfs mount
 	doupdatefileumnt("")
 
 	pkg.DestroyMdDev()
 
+	// Record what we ended up installing
+	completemanifest()
+
 	// SUCCESS! Lets finish and activate the new BE
 	activateBe()
 
-	// Update the bootloader
-	UpdateLoader("")
+	// Update the bootloader, keeping how it went for after the reboot. The
+	// system carries on booting from here, so there is no next boot to
+	// set BootNext for.
+	report := UpdateLoader("", false)
+	info.Loader = &report
+	if report.Status != "ok" {
+		sendnotify(notify.NewEvent("failed", loaderproblems(report)))
+	}
+
+	if err := hooks.Run(hooks.PostStage2, env); err != nil {
+		copylogexit(err, err.Error())
+		// Go back to the BE we came from
+		exec.Command(defines.BEBIN, "activate", info.OldBEName).Run()
+		DefaultRebooter.Reboot()
+		return
+	}
+
+	// Finish up once we've booted
+	writepostbootstate(info)
+
+	ev := notify.NewEvent("completed", "Update completed")
+	if report.Status != "ok" {
+		ev.Message += ", boot loader update " + report.Status
+	}
+	ev.BEName = info.BEName
+	sendnotify(ev)
 
 	os.Exit(0)
 
@@ -1093,40 +1297,92 @@ func activateBe() {
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		copylogexit(err, "Failed beadm activate: "+bename+"\n"+string(output))
-		rebootNow()
+		DefaultRebooter.Reboot()
 	}
 }
 
-func renamebe() {
-	BENAME := defines.BESTAGE
-	location := "/etc/version"
-
-	if defines.BeNameFlag != "" {
-		BENAME = defines.BeNameFlag
-	} else {
-		// If /etc/version exists we will use that instead of a date
-		_, err := os.Stat(location)
-
+// Get the OS version new boot-environments are named after, if known
+func osversion() (string, error) {
+	for _, location := range []string{"/etc/version", "/etc/base_version"} {
+		version, err := ioutil.ReadFile(location)
 		if os.IsNotExist(err) {
-			// TrueOS
-			location = "/etc/base_version"
-			_, err = os.Stat(location)
+			continue
 		}
+		if err != nil {
+			return "", errors.New("Failed reading: " + location)
+		}
+		if fields := bytes.Fields(version); len(fields) > 0 {
+			return string(fields[0]), nil
+		}
+	}
+	return "", nil
+}
 
-		if !os.IsNotExist(err) {
-			version, err := ioutil.ReadFile(location)
+// Get the name the new boot-environment will be renamed to
+//
+// The name comes from -bename, or else the benametemplate config option. It
+// is checked against the existing boot-environments so we can fail before
+// any work is done
+func getbename() (string, error) {
+	bes, err := listbes()
+	if err != nil {
+		return "", err
+	}
+	// The staging BE is replaced, so it doesn't count as taken
+	taken := func(name string) bool {
+		_, ok := findbe(bes, name)
+		return ok && name != defines.BESTAGE
+	}
 
-			if err != nil {
-				logger.LogToFile("Failed reading " + location)
-				ws.SendMsg("Failed reading: "+location, "fatal")
-				log.Fatal(err)
-			}
+	if defines.BeNameFlag != "" {
+		if err := validbename(defines.BeNameFlag); err != nil {
+			return "", err
+		}
+		if taken(defines.BeNameFlag) {
+			return "", errors.New(
+				"Boot-environment already exists: " + defines.BeNameFlag,
+			)
+		}
+		return defines.BeNameFlag, nil
+	}
 
-			// Set new BE name, but keep date / timestamp
-			BENAME = string(bytes.Fields(version)[0]) + "_" + defines.BESTAGE
+	version, err := osversion()
+	if err != nil {
+		return "", err
+	}
+	tmpl := defines.BENameTemplate
+	if tmpl == "" {
+		tmpl = defines.DefaultBENameTemplate
+		if version == "" {
+			tmpl = "{date}"
 		}
 	}
+	vals := defines.BENameValues{Version: version, Date: time.Now()}
+	if strings.Contains(tmpl, "{train}") {
+		vals.Train = trains.CurrentTrain()
+	}
+
+	for seq := 1; ; seq++ {
+		name, err := defines.ExpandBEName(tmpl, vals, seq)
+		if err != nil {
+			return "", err
+		}
+		if err := validbename(name); err != nil {
+			return "", err
+		}
+		if !taken(name) {
+			return name, nil
+		}
+		if !defines.BENameHasSeq(tmpl) {
+			return "", errors.New(
+				"Boot-environment already exists: " + name +
+					", use -bename or add {seq} to benametemplate",
+			)
+		}
+	}
+}
 
+func renamebe(BENAME string) error {
 	// Write the new BE name
 	fdata := BENAME
 	ioutil.WriteFile(defines.STAGEDIR+"/.updategobename", []byte(fdata), 0644)
@@ -1142,7 +1398,7 @@ func renamebe() {
 	if err != nil {
 		logger.LogToFile("Failed touching " + loaderConf)
 		ws.SendMsg("Failed touching: "+loaderConf, "fatal")
-		return
+		return errors.New("Failed touching: " + loaderConf)
 	}
 
 	// Unmount /dev
@@ -1159,7 +1415,7 @@ func renamebe() {
 	if err != nil {
 		logger.LogToFile("Failed beadm umount -f")
 		ws.SendMsg("Failed unmounting: "+defines.BESTAGE, "fatal")
-		return
+		return errors.New("Failed unmounting: " + defines.BESTAGE)
 	}
 
 	// Now rename BE
@@ -1169,7 +1425,9 @@ func renamebe() {
 		if err != nil {
 			logger.LogToFile("Failed renaming: " + defines.BESTAGE + " -> " + BENAME)
 			ws.SendMsg("Failed renaming: "+defines.BESTAGE+" -> "+BENAME, "fatal")
-			return
+			return errors.New(
+				"Failed renaming: " + defines.BESTAGE + " -> " + BENAME,
+			)
 		}
 	}
 
@@ -1179,9 +1437,10 @@ func renamebe() {
 	if err != nil {
 		logger.LogToFile("Failed beadm activate")
 		ws.SendMsg("Failed activating: "+BENAME, "fatal")
-		return
+		return errors.New("Failed activating: " + BENAME)
 	}
 
+	return nil
 }
 
 /*
@@ -1192,6 +1451,7 @@ func copylogexit(perr error, text string) {
 	exec.Command("cp", defines.LogFile, "/var/log/sysup.failed").Run()
 
 	ws.SendMsg("Aborting", "fatal")
+	sendnotify(notify.NewEvent("failed", text))
 	logger.LogToFile("FAILED Upgrade!!!")
 	logger.LogToFile(perr.Error())
 	logger.LogToFile(text)
@@ -1199,9 +1459,15 @@ func copylogexit(perr error, text string) {
 
 }
 
-// We've failed, lets reboot back into the old BE
-func rebootNow() {
-	exec.Command("reboot").Run()
+// Let anyone listening know how the update went. During stage 2 there
+// is no network yet, so the event is queued until sysup next runs as a
+// daemon.
+func sendnotify(ev notify.Event) {
+	if defines.Stage2Flag {
+		notify.Queue(ev)
+		return
+	}
+	notify.Deliver(ev)
 }
 
 func startpkgfetch() error {
@@ -1233,6 +1499,7 @@ func startfetch() error {
 	if defines.FullUpdateFlag {
 		cmd.Args = append(cmd.Args, "-f")
 	}
+	cmd.Args = append(cmd.Args, pkg.OnlyPkgs()...)
 
 	ws.SendMsg("Starting package downloads")
 	stdout, err := cmd.StdoutPipe()
@@ -1270,183 +1537,44 @@ func startfetch() error {
 	return nil
 }
 
-func UpdateLoader(stagedir string) {
+// Update the boot loader on every boot partition of the pool's disks,
+// setting BootNext if configured and bootnext is set
+func UpdateLoader(stagedir string, bootnext bool) defines.LoaderReport {
 	logger.LogToFile("Updating Bootloader\n-------------------")
 	ws.SendMsg("Updating Bootloader")
-	disks := getzpooldisks()
-	for i := range disks {
-		if isuefi(disks[i]) {
-			logger.LogToFile("Updating EFI bootloader on: " + disks[i])
-			ws.SendMsg("Updating EFI bootloader on: " + disks[i])
-			if !updateuefi(disks[i], stagedir) {
-				ws.SendMsg("Updating bootloader failed!", "fatal")
-			}
-		} else {
-			logger.LogToFile("Updating GPT bootloader on: " + disks[i])
-			ws.SendMsg("Updating GPT bootloader on: " + disks[i])
-			if !updategpt(disks[i], stagedir) {
-				ws.SendMsg("Updating bootloader failed!", "fatal")
-			}
-		}
-	}
-}
-
-func updateuefi(disk string, stagedir string) bool {
-	derr := os.MkdirAll("/boot/efi", 0755)
-	if derr != nil {
-		ws.SendMsg("ERROR: Failed mkdir /boot/efi")
-		copylogexit(derr, "Failed mkdir /boot/efi")
+	report := runloader(stagedir, true, bootnext)
+	if report.Error != "" {
+		logger.LogToFile(report.Error)
 	}
-
-	cmd := exec.Command("gpart", "show", disk)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		ws.SendMsg("ERROR: Failed gpart show")
-		copylogexit(derr, "Failed gpart show")
-	}
-	if err := cmd.Start(); err != nil {
-		ws.SendMsg("ERROR: Failed starting gpart show")
-		copylogexit(derr, "Failed starting gpart show")
-	}
-	buff := bufio.NewScanner(stdout)
-
-	// Iterate over buff and look for specific boot partition
-	for buff.Scan() {
-		line := strings.TrimSpace(buff.Text())
-		if strings.Contains(line, " efi ") {
-			linearray := strings.Fields(line)
-			if len(linearray) < 3 {
-				ws.SendMsg("ERROR: Unable to locate EFI partition")
-				logger.LogToFile(
-					"Unable to locate EFI partition..." + string(line),
-				)
-				return false
-			}
-			part := linearray[2]
-
-			// Mount the UEFI partition
-			bcmd := exec.Command(
-				"mount", "-t", "msdosfs", "/dev/"+disk+"p"+part, "/boot/efi",
-			)
-			berr := bcmd.Run()
-			if berr != nil {
-				ws.SendMsg("ERROR: Unable to mount EFI partition")
-				logger.LogToFile("Unable to mount EFI partition: " + part)
-				return false
-			}
-
-			// Copy the new UEFI file over
-			var tgt string
-			if _, err := os.Stat(
-				"/boot/efi/efi/boot/bootx64-trueos.efi",
-			); os.IsNotExist(err) {
-				tgt = "/boot/efi/efi/boot/bootx64-trueos.efi"
-			} else {
-				tgt = "/boot/efi/efi/boot/bootx64.efi"
-			}
-			cmd := exec.Command("cp", stagedir+"/boot/loader.efi", tgt)
-			cerr := cmd.Run()
-			if cerr != nil {
-				ws.SendMsg("ERROR: Unable to copy efi file " + tgt)
-				logger.LogToFile("Unable to copy efi file: " + tgt)
-				return false
-			}
-
-			// Unmount and cleanup
-			bcmd = exec.Command("umount", "-f", "/boot/efi")
-			berr = bcmd.Run()
-			if berr != nil {
-				ws.SendMsg("ERROR: Unable to umount EFI pratition " + part)
-				logger.LogToFile("Unable to umount EFI partition: " + part)
-				return false
-			}
-
-			return true
+	for _, d := range report.Disks {
+		if d.Error != "" {
+			logger.LogToFile(d.Error)
 		}
-	}
-	ws.SendMsg("ERROR: Unable to locate EFI partition on: " + string(disk))
-	logger.LogToFile("Unable to locate EFI partition on: " + string(disk))
-	return false
-}
-
-func updategpt(disk string, stagedir string) bool {
-	cmd := exec.Command("gpart", "show", disk)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		ws.SendMsg("ERROR: Failed gpart show")
-		logger.LogToFile("ERROR: Failed gpart show")
-		return false
-	}
-	if err := cmd.Start(); err != nil {
-		ws.SendMsg("ERROR: Failed starting gpart show")
-		logger.LogToFile("ERROR: Failed starting gpart show")
-		return false
-	}
-	buff := bufio.NewScanner(stdout)
-
-	// Iterate over buff and look for specific boot partition
-	for buff.Scan() {
-		line := strings.TrimSpace(buff.Text())
-		if strings.Contains(line, " freebsd-boot ") {
-			linearray := strings.Fields(line)
-			if len(linearray) < 3 {
-				ws.SendMsg("ERROR: Failed to locate GPT boot partition...")
-				logger.LogToFile(
-					"Unable to locate GPT boot partition..." + string(line),
-				)
-				return false
-			}
-			part := linearray[2]
-			bcmd := exec.Command(
-				"gpart", "bootcode", "-b", stagedir+"/boot/pmbr", "-p",
-				stagedir+"/boot/gptzfsboot", "-i", part, disk,
-			)
-			berr := bcmd.Run()
-			if berr != nil {
-				ws.SendMsg(
-					"Failed gpart bootcode -b " + stagedir + "/boot/pmbr -p " +
-						stagedir + "/boot/gptzfsboot -i " + part + " " + disk,
-				)
-				logger.LogToFile(
-					"Failed gpart bootcode -b " + stagedir + "/boot/pmbr -p " +
-						stagedir + "/boot/gptzfsboot -i " + part + " " + disk,
-				)
-				return false
-			}
-			return true
+		for _, p := range d.Partitions {
+			logger.LogToFile(p.Partition + " (" + p.Type + "): " + p.Result)
 		}
 	}
-	ws.SendMsg(
-		"Unable to locate freebsd-boot partition on: " + string(disk),
-	)
-	logger.LogToFile(
-		"Unable to locate freebsd-boot partition on: " + string(disk),
-	)
-	return false
+	logger.LogToFile("Bootloader update status: " + report.Status)
+	if report.Status != "ok" {
+		ws.SendMsg("Updating bootloader " + report.Status + "!")
+	}
+	return report
 }
 
-func isuefi(disk string) bool {
-	cmd := exec.Command("gpart", "show", disk)
-	stdout, err := cmd.StdoutPipe()
+func updategpt(disk disks.Disk, part disks.Partition, stagedir string) error {
+	index := strconv.Itoa(part.Index)
+	out, err := exec.Command(
+		"gpart", "bootcode", "-b", stagedir+"/boot/pmbr", "-p",
+		stagedir+"/boot/gptzfsboot", "-i", index, disk.Name,
+	).CombinedOutput()
 	if err != nil {
-		copylogexit(err, "Failed gpart show (isuefi)")
-	}
-	if err := cmd.Start(); err != nil {
-		copylogexit(err, "Failed starting gpart show (isuefiu)")
-	}
-	buff := bufio.NewScanner(stdout)
-
-	// Iterate over buff and look for disk matches
-	for buff.Scan() {
-		line := buff.Text()
-		if strings.Contains(line, " efi ") {
-			return true
-		}
-		if strings.Contains(line, "freebsd-boot") {
-			return false
-		}
+		return errors.New(
+			"Failed gpart bootcode -b " + stagedir + "/boot/pmbr -p " +
+				stagedir + "/boot/gptzfsboot -i " + index + " " + disk.Name +
+				": " + strings.TrimSpace(string(out)),
+		)
 	}
-	return false
+	return nil
 }
 
 func getberoot() string {
@@ -1496,87 +1624,21 @@ func getzfspool() string {
 	return linearray[0]
 }
 
-func getzpooldisks() []string {
-	var diskarr []string
-	zpool := getzfspool()
-	kernout, kerr := syscall.Sysctl("kern.disks")
-	if kerr != nil {
-		logger.LogToFile("ERROR: Failed getting kern.disks")
-		log.Fatal(kerr)
-	}
-	kerndisks := strings.Split(string(kernout), " ")
-	for i := range kerndisks {
-		// Yes, CD's show up in this output..
-		if strings.Index(kerndisks[i], "cd") == 0 {
-			continue
-		}
-		// Get a list of uuids for the partitions on this disk
-		duuids := getdiskuuids(kerndisks[i])
-
-		// Validate this disk is in the default zpool
-		if !diskisinpool(kerndisks[i], duuids, zpool) {
-			continue
-		}
-		logger.LogToFile("Updating bootloader on disk: " + kerndisks[i])
-		diskarr = append(diskarr, kerndisks[i])
-	}
-	return diskarr
-}
-
-func diskisinpool(disk string, uuids []string, zpool string) bool {
-	cmd := exec.Command("zpool", "status", zpool)
-	stdout, err := cmd.StdoutPipe()
+// Get the partitioned disks of the pool we boot from
+func getzpooldisks() ([]disks.Disk, error) {
+	topo, err := disks.Load()
 	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	buff := bufio.NewScanner(stdout)
-
-	// Iterate over buff and look for disk matches
-	for buff.Scan() {
-		line := buff.Text()
-		if strings.Contains(line, " "+disk+" ") {
-			return true
-		}
-		if strings.Contains(line, " "+disk+"p") {
-			return true
-		}
-		for i := range uuids {
-			if strings.Contains(line, " gptid/"+uuids[i]) {
-				return true
-			}
-		}
-	}
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return false
-}
-
-func getdiskuuids(disk string) []string {
-	var uuidarr []string
-	shellcmd := "gpart list " + disk + " | grep rawuuid | awk '{print $2}'"
-	cmd := exec.Command("/bin/sh", "-c", shellcmd)
-	stdout, err := cmd.StdoutPipe()
+	disklist, err := topo.PoolDisks(getzfspool())
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	buff := bufio.NewScanner(stdout)
-
-	// Iterate over buff and append content to the slice
-	for buff.Scan() {
-		line := buff.Text()
-		uuidarr = append(uuidarr, line)
-	}
-	// Pkg returns 0 on success
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	for _, d := range disklist {
+		logger.LogToFile(
+			"Found boot disk in pool: " + d.Name + " (" +
+				strings.Join(d.Physical, " ") + ")",
+		)
 	}
-
-	return uuidarr
+	return disklist, nil
 }
@@ -3,8 +3,12 @@ package utils
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func Copyfile(src, dst string) (int64, error) {
@@ -32,6 +36,74 @@ func Copyfile(src, dst string) (int64, error) {
 	return nBytes, err
 }
 
+// Write a file via a temp file in the same directory and rename it into place
+// so readers never see a partially written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Compare two package style version strings (1.2.10_1) returning -1, 0 or 1
+// if a is older, the same or newer than b
+func CompareVersions(a, b string) int {
+	split := func(r rune) bool {
+		return r == '.' || r == '_' || r == ',' || r == '-'
+	}
+	af := strings.FieldsFunc(a, split)
+	bf := strings.FieldsFunc(b, split)
+	for i := 0; i < len(af) || i < len(bf); i++ {
+		var ap, bp string
+		if i < len(af) {
+			ap = af[i]
+		}
+		if i < len(bf) {
+			bp = bf[i]
+		}
+		an, aerr := strconv.Atoi(ap)
+		bn, berr := strconv.Atoi(bp)
+		if ap == "" {
+			aerr = nil
+		}
+		if bp == "" {
+			berr = nil
+		}
+		switch {
+		case aerr == nil && berr == nil:
+			if an < bn {
+				return -1
+			}
+			if an > bn {
+				return 1
+			}
+		case ap < bp:
+			return -1
+		case ap > bp:
+			return 1
+		}
+	}
+	return 0
+}
+
 func GetFreePort() (int, error) {
 	ln, err := net.Listen("tcp", ":0")
 	defer ln.Close()
@@ -14,7 +14,8 @@ type JSONReply struct {
 }
 
 func SendMsg(msg string, msg_type ...string) {
-	if defines.DisableWSMsg {
+	// Nobody to talk to, such as a scheduled run with no clients
+	if defines.DisableWSMsg || defines.WSServer == nil {
 		log.Println(msg)
 		return
 	}
@@ -42,6 +43,26 @@ func SendMsg(msg string, msg_type ...string) {
 	}
 }
 
+// Send a JSON message to any connected client, without failing if there is
+// nobody listening
+func Broadcast(data interface{}) {
+	j_msg, err := json.Marshal(data)
+	if err != nil {
+		log.Fatal("Failed encoding JSON:", err)
+	}
+
+	if defines.DisableWSMsg || defines.WSServer == nil {
+		log.Println(string(j_msg))
+		return
+	}
+
+	if err := defines.WSServer.WriteMessage(
+		websocket.TextMessage, j_msg,
+	); err != nil {
+		log.Println("broadcast:", err)
+	}
+}
+
 // Called when we want to signal that its time to close the WS connection
 func CloseWs() {
 	log.Println("Closing WS connection")